@@ -0,0 +1,150 @@
+package htmpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vktec/htmpl/internal/builtin"
+)
+
+// builtinFuncs are the functions available to all templates, unless replaced by functions in Config.Funcs
+var builtinFuncs = FuncMap{
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"title":     builtin.Title,
+	"trim":      strings.TrimSpace,
+	"truncate":  builtin.Truncate,
+	"join":      join,
+	"default":   defaultValue,
+	"len":       length,
+	"first":     first,
+	"last":      last,
+	"slice":     slice,
+	"urlquery":  urlquery,
+	"json":      toJSON,
+	"pluralize": pluralize,
+	"printf":    printf,
+}
+
+// join converts the elements of an array to strings and joins them with a separator
+func join(list interface{}, sep string) (string, error) {
+	v := unwrap(reflect.ValueOf(list))
+	switch v.Kind() {
+	case reflect.Invalid:
+		return "", nil
+	case reflect.Array, reflect.Slice:
+	default:
+		return "", fmt.Errorf("cannot join %s", v.Type())
+	}
+	parts := make([]string, v.Len())
+	for i := range parts {
+		parts[i] = stringify(unwrap(v.Index(i)))
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// defaultValue returns def if v is falsey, and v otherwise
+func defaultValue(v, def interface{}) interface{} {
+	if Truthy(v) {
+		return v
+	}
+	return def
+}
+
+// length returns the number of characters in a string, or the number of elements in an array or map
+func length(v interface{}) (int, error) {
+	rv := unwrap(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return 0, nil
+	case reflect.String:
+		return utf8.RuneCountInString(rv.String()), nil
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.Chan:
+		return rv.Len(), nil
+	}
+	return 0, fmt.Errorf("cannot take length of %s", rv.Type())
+}
+
+// first returns the first element of an array, or an empty if it has none
+func first(list interface{}) (interface{}, error) {
+	return element(list, 0)
+}
+
+// last returns the last element of an array, or an empty if it has none
+func last(list interface{}) (interface{}, error) {
+	return element(list, -1)
+}
+
+// element returns the element at index i of an array, counting from the end if i is negative
+func element(list interface{}, i int) (interface{}, error) {
+	v := unwrap(reflect.ValueOf(list))
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Array, reflect.Slice:
+	default:
+		return nil, fmt.Errorf("cannot take element of %s", v.Type())
+	}
+	if i < 0 {
+		i += v.Len()
+	}
+	if i < 0 || i >= v.Len() {
+		return nil, nil
+	}
+	return v.Index(i).Interface(), nil
+}
+
+// slice returns the part of a string or array from index i up to, but not including, index j.
+// If j is omitted, the part extends to the end. Indices are clamped to the bounds of the value.
+func slice(v interface{}, i int, j ...int) (interface{}, error) {
+	if len(j) > 1 {
+		return nil, fmt.Errorf("too many indices: expected at most 2, received %d", len(j)+1)
+	}
+	rv := unwrap(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.String:
+		r := []rune(rv.String())
+		start, end := builtin.SliceBounds(len(r), i, j...)
+		return string(r[start:end]), nil
+	case reflect.Array, reflect.Slice:
+		if rv.Kind() == reflect.Array && !rv.CanAddr() {
+			// Arrays must be addressable to be sliced
+			c := reflect.New(rv.Type()).Elem()
+			c.Set(rv)
+			rv = c
+		}
+		start, end := builtin.SliceBounds(rv.Len(), i, j...)
+		return rv.Slice(start, end).Interface(), nil
+	}
+	return nil, fmt.Errorf("cannot slice %s", rv.Type())
+}
+
+// urlquery converts a value to a string and escapes it for use in a URL query
+func urlquery(v interface{}) string {
+	return url.QueryEscape(stringify(unwrap(reflect.ValueOf(v))))
+}
+
+// toJSON encodes a value as JSON
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// pluralize returns singular if n is 1, and plural otherwise
+func pluralize(n float64, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
+
+// printf formats the piped value and any other arguments according to a format string
+func printf(v interface{}, format string, args ...interface{}) string {
+	return fmt.Sprintf(format, append([]interface{}{v}, args...)...)
+}
@@ -3,43 +3,53 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
-	"github.com/vktec/htmlparse"
 	"github.com/vktec/htmpl"
 	"github.com/vktec/htmpl/gen"
-	"golang.org/x/net/html"
 )
 
 func main() {
-	tmplFile := flag.String("t", "", "template `file`name")
+	tmplFile := flag.String("t", "", "template `file`name. Included templates are loaded relative to the template's directory")
 	dataStr := flag.String("d", "", "`JSON` data to render the template with. If not specified, htmpl will read from stdin")
 	genPath := flag.String("gen", "", "generate a Go source `file`")
 	genFunc := flag.String("func", "Evaluate", "function `name` to generate")
 	genType := flag.String("type", "interface{}", "`type` of generated function's dot argument")
+	genFuncs := flag.String("funcs", "", "comma-separated `name=expr` pairs of Go functions callable from the generated code")
+	genTags := flag.Bool("tags", false, "name struct fields in the generated code by their htmpl or json struct tags")
+	genPolicy := flag.String("policy", "", "Go `expr`ession for the *htmpl.Policy sanitizing noescape output in the generated code. If not specified, noescape output is not sanitized")
 	flag.Parse()
 	log.SetFlags(0)
 
 	if *tmplFile == "" {
 		log.Fatal("-t must be provided")
 	}
-	tmpl, err := ioutil.ReadFile(*tmplFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	node := &html.Node{Type: html.DocumentNode}
-	if err := htmlparse.Parse(node, tmpl); err != nil {
-		log.Fatal(err)
+	dir, name := filepath.Split(*tmplFile)
+	if dir == "" {
+		dir = "."
 	}
+	fsys := os.DirFS(dir)
 
 	if *genPath != "" {
-		if err := gen.Generate(*genPath, *genFunc, *genType, node); err != nil {
+		config := &gen.Config{FS: fsys, Funcs: map[string]string{}, StructTags: *genTags, Policy: *genPolicy}
+		if *genFuncs != "" {
+			for _, pair := range strings.Split(*genFuncs, ",") {
+				name, expr, ok := strings.Cut(pair, "=")
+				if !ok {
+					log.Fatalf("invalid function %q: expected name=expr", pair)
+				}
+				config.Funcs[name] = expr
+			}
+		}
+		if err := config.GenerateFile(*genPath, *genFunc, *genType, name); err != nil {
 			log.Fatal(err)
 		}
 	} else {
 		var data map[string]interface{}
+		var err error
 		if *dataStr != "" {
 			err = json.Unmarshal([]byte(*dataStr), &data)
 		} else {
@@ -49,12 +59,12 @@ func main() {
 			log.Fatal(err)
 		}
 
-		nodes := htmpl.Evaluate(node, data)
-		result := &html.Node{Type: html.DocumentNode}
-		for _, child := range nodes {
-			result.AppendChild(child)
+		config := &htmpl.Config{FS: fsys}
+		t, err := config.ParseFile(name)
+		if err == nil {
+			err = t.Execute(os.Stdout, data)
 		}
-		if err := html.Render(os.Stdout, result); err != nil {
+		if err != nil {
 			log.Fatal(err)
 		}
 	}
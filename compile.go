@@ -0,0 +1,800 @@
+package htmpl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/vktec/htmpl/internal/htmlcontext"
+	"golang.org/x/net/html"
+)
+
+// An instr is a single instruction in a compiled template
+type instr interface{}
+
+// staticInstr inserts a copy of a node that contains no template elements
+type staticInstr struct {
+	node *html.Node
+
+	// The node, pre-rendered by html.Render
+	html      string
+	err       error
+	plaintext bool // Whether the node contains a <plaintext> element
+}
+
+func newStaticInstr(node *html.Node) *staticInstr {
+	b := strings.Builder{}
+	err := html.Render(&b, node)
+	return &staticInstr{node, b.String(), err, containsPlaintext(node)}
+}
+
+// elementInstr inserts an ordinary element, some of whose attributes or descendants are dynamic
+type elementInstr struct {
+	node  *html.Node
+	attrs []attrInstr
+	body  []instr
+}
+type attrInstr struct {
+	attr html.Attribute
+	val  expr    // The expression to substitute into the attribute, or nil for static attributes
+	ctx  Context // The context of the attribute's value
+}
+
+// ifInstr evaluates its body iff the condition is truthy, or falsey if negate is set.
+// Otherwise, it evaluates els, which contains the following <elif> or <else> branch.
+type ifInstr struct {
+	cond   expr
+	negate bool
+	body   []instr
+	els    []instr
+}
+
+// switchInstr evaluates the body of the first case equal to a value, or the default body if there is none
+type switchInstr struct {
+	val   expr
+	cases []caseInstr
+	def   []instr
+}
+type caseInstr struct {
+	literal bool // Whether the case compares the string form of the value with is, rather than comparing with val
+	is      string
+	val     expr
+	body    []instr
+}
+
+// forInstr evaluates its body once for each item in a collection
+type forInstr struct {
+	coll           expr
+	from, to, step *boundExpr // The bounds of a numeric range to iterate over instead, if to is not nil
+	sorted         bool       // Whether maps are iterated in the order of their keys
+	tags           bool       // Whether struct fields are named by their struct tags
+	key, val       string     // The variables to bind each item's key and value to, if any
+	body           []instr
+}
+
+// A boundExpr is an expression for a bound of a numeric range
+type boundExpr struct {
+	*source
+	val expr
+}
+
+// letInstr binds a variable while evaluating its body
+type letInstr struct {
+	name string
+	val  expr
+	body []instr
+}
+
+// includeInstr evaluates another template
+type includeInstr struct {
+	tmpl *Template
+	dot  expr // The value to use as dot in the included template, or nil to use the current dot
+}
+
+// componentInstr evaluates a component, binding its attributes as variables
+type componentInstr struct {
+	comp  *component
+	attrs []componentAttr
+	slots map[string][]instr // The content provided for each slot, evaluated in the scope of the caller
+}
+type componentAttr struct {
+	name string
+	val  expr
+}
+
+// slotInstr evaluates the content provided for a slot by the caller of the current component, or its body if there is none
+type slotInstr struct {
+	name string
+	body []instr
+}
+
+// vInstr substitutes the value of an expression
+type vInstr struct {
+	val      expr
+	noescape bool
+	policy   *Policy // The policy sanitizing HTML parsed from the value, if noescape is set
+	ctx      Context // The context the value is substituted into
+}
+
+// A source identifies the expression containing a path or function call, for error reporting
+type source struct {
+	file *file      // The file containing the expression
+	node *html.Node // The node containing the expression
+	attr string     // The attribute containing the expression, if any
+	src  string
+}
+
+// A path is a parsed variable path
+type path struct {
+	*source
+	head string // The name of the variable the path starts at
+	keys []*pathKey
+	tags bool // Whether struct fields are named by their struct tags
+}
+type pathKey struct {
+	name string
+	path *path // If non-nil, the key is the value of this path
+
+	// The struct type last indexed with a static key, and the index of the resulting field.
+	// This avoids looking up the field by name on every evaluation.
+	field atomic.Pointer[fieldCache]
+}
+type fieldCache struct {
+	ty    reflect.Type
+	index []int
+}
+
+// index indexes a value with the key, which has the given name.
+func (key *pathKey) index(v reflect.Value, name string, tags bool) (reflect.Value, error) {
+	if v.Kind() != reflect.Struct || key.path != nil {
+		return index(v, name, tags)
+	}
+
+	cache := key.field.Load()
+	if cache == nil || cache.ty != v.Type() {
+		f, ok := fieldByName(v.Type(), name, tags)
+		pt := reflect.PointerTo(v.Type())
+		if _, m := pt.MethodByName(name); !ok || m || pt.Implements(lookuperType) {
+			// Lookup and methods take precedence over fields, and are not cached
+			return index(v, name, tags)
+		}
+		cache = &fieldCache{v.Type(), f.Index}
+		key.field.Store(cache)
+	}
+	return unwrap(fieldByIndex(v, cache.index)), nil
+}
+
+// compiler translates a parsed template into a sequence of instructions
+type compiler struct {
+	config     *Config
+	file       *file
+	stack      []string             // The names of the templates currently being compiled, for detecting include cycles
+	overrides  map[string]*override // Blocks overridden by templates extending the one being compiled
+	components map[string]*component
+	err        error
+}
+
+// A component is a reusable element defined by a <define> element
+type component struct {
+	name string
+	prog []instr
+}
+
+// builtins is the set of elements that cannot be defined as components
+var builtins = map[string]bool{
+	"block":   true,
+	"case":    true,
+	"default": true,
+	"define":  true,
+	"elif":    true,
+	"else":    true,
+	"extends": true,
+	"for":     true,
+	"if":      true,
+	"include": true,
+	"let":     true,
+	"nif":     true,
+	"slot":    true,
+	"switch":  true,
+	"v":       true,
+}
+
+// An override replaces the content of a block in a layout
+type override struct {
+	node *html.Node // The <block> element containing the new content
+	file *file
+	used bool
+}
+
+// compile compiles a template.
+// Even if an error is returned, the template is still usable; any invalid parts evaluate to nothing.
+func compile(config *Config, f *file, node *html.Node, stack []string) (*Template, error) {
+	c := compiler{config: config, file: f, stack: stack}
+	c.define(node)
+	prog := c.compile(node)
+	return &Template{prog: prog, node: node, file: f, components: c.components}, c.err
+}
+
+// sub compiles part of another file, using the given overrides
+func (c *compiler) sub(f *file, node *html.Node, overrides map[string]*override) []instr {
+	sub := *c
+	sub.file = f
+	sub.overrides = overrides
+	prog := sub.compile(node)
+	if c.err == nil {
+		c.err = sub.err
+	}
+	return prog
+}
+
+// fail records a problem with the template. Only the first problem is kept.
+func (c *compiler) fail(node *html.Node, attr, path string, err error) {
+	if c.err == nil {
+		c.err = c.file.error(node, attr, path, err)
+	}
+}
+
+func (c *compiler) compile(node *html.Node) []instr {
+	switch node.Type {
+	case html.DocumentNode:
+		return c.children(node)
+
+	case html.ElementNode:
+		switch node.Data {
+		case "if", "nif":
+			return []instr{c.cond(node, nil)}
+
+		case "switch":
+			return []instr{c.switch_(node)}
+
+		case "case", "default":
+			c.fail(node, "", "", fmt.Errorf("<%s> must be within <switch>", node.Data))
+			return nil
+
+		case "elif", "else":
+			c.fail(node, "", "", fmt.Errorf("<%s> must follow <if>, <nif> or <elif>", node.Data))
+			return nil
+
+		case "for":
+			in := &forInstr{}
+			in.from, in.to, in.step = c.bound(node, "from"), c.bound(node, "to"), c.bound(node, "step")
+			if _, ok := getAttr(node, "v"); ok && in.to != nil {
+				c.fail(node, "", "", errors.New("<for> must not have both v and to attributes"))
+			} else if in.to == nil && (in.from != nil || in.step != nil) {
+				c.fail(node, "to", "", errMissingAttr)
+			} else if in.to == nil {
+				in.coll = c.attr(node, "v")
+			}
+			_, sorted := getAttr(node, "sort")
+			in.sorted = sorted || c.config.SortMaps
+			in.tags = c.config.StructTags
+			for _, attr := range []string{"key", "val"} {
+				if name, _ := getAttr(node, attr); name == "loop" {
+					c.fail(node, attr, "", fmt.Errorf("variable %q is reserved", name))
+				}
+			}
+			in.key, _ = getAttr(node, "key")
+			in.val, _ = getAttr(node, "val")
+			in.body = c.children(node)
+			return []instr{in}
+
+		case "let":
+			varName, ok := getAttr(node, "var")
+			if !ok {
+				c.fail(node, "var", "", errMissingAttr)
+			} else if varName == "loop" {
+				c.fail(node, "var", "", fmt.Errorf("variable %q is reserved", varName))
+			}
+			return []instr{&letInstr{varName, c.attr(node, "val"), c.children(node)}}
+
+		case "include":
+			in := &includeInstr{}
+			if src, ok := getAttr(node, "src"); !ok {
+				c.fail(node, "src", "", errMissingAttr)
+			} else if tmpl, err := c.config.load(src, c.stack); err != nil {
+				if herr, ok := err.(*Error); ok && c.err == nil {
+					// Report problems within the included template directly
+					c.err = herr
+				}
+				c.fail(node, "src", "", err)
+			} else {
+				in.tmpl = tmpl
+			}
+			if _, ok := getAttr(node, "dot"); ok {
+				in.dot = c.attr(node, "dot")
+			}
+			return []instr{in}
+
+		case "extends":
+			return c.extends(node)
+
+		case "block":
+			name, ok := getAttr(node, "name")
+			if !ok {
+				c.fail(node, "name", "", errMissingAttr)
+			}
+			o := c.overrides[name]
+			if o == nil {
+				return c.children(node)
+			}
+
+			// Compile the overriding content, which cannot itself be overridden with the same name
+			o.used = true
+			overrides := make(map[string]*override, len(c.overrides))
+			for n, o := range c.overrides {
+				if n != name {
+					overrides[n] = o
+				}
+			}
+			return c.sub(o.file, o.node, overrides)
+
+		case "define":
+			// Compiled by define
+			return nil
+
+		case "slot":
+			name, _ := getAttr(node, "name")
+			return []instr{&slotInstr{name, c.children(node)}}
+
+		case "v":
+			// FIXME: should handle multiple child nodes
+			if node.FirstChild != nil && node.FirstChild.Type == html.TextNode {
+				_, noescape := getAttr(node, "noescape")
+				return []instr{&vInstr{val: c.expr(node, "", node.FirstChild.Data), noescape: noescape, policy: c.config.Policy}}
+			} else {
+				c.fail(node, "", "", errors.New("<v> must contain a variable path"))
+				return nil
+			}
+
+		default:
+			if comp := c.components[node.Data]; comp != nil {
+				return c.call(comp, node)
+			}
+			attrs, dynamic := c.attrs(node)
+			var body []instr
+			if isRawText(node) {
+				body, attrs, dynamic = c.rawText(node), withoutAttr(attrs, "v"), true
+			} else {
+				body = c.children(node)
+			}
+			if !dynamic && isStatic(body) {
+				// Rebuild the element from its compiled children, as blocks may have replaced parts of it
+				static := shallowClone(node)
+				for _, in := range body {
+					static.AppendChild(deepClone(in.(*staticInstr).node))
+				}
+				return []instr{newStaticInstr(static)}
+			}
+			return []instr{&elementInstr{node, attrs, body}}
+		}
+
+	default:
+		return []instr{newStaticInstr(node)}
+	}
+}
+
+// define compiles the components defined by a template.
+// Components defined by included templates and layouts are also available, unless a component with the same name is defined.
+func (c *compiler) define(root *html.Node) {
+	c.components = make(map[string]*component)
+	var defs []*html.Node
+	var find func(node *html.Node)
+	find = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch child.Data {
+			case "define":
+				defs = append(defs, child)
+				continue
+			case "include", "extends":
+				// Problems loading the template are reported when the element is compiled
+				if src, ok := getAttr(child, "src"); ok {
+					if t, err := c.config.load(src, c.stack); err == nil {
+						for name, comp := range t.components {
+							c.components[name] = comp
+						}
+					}
+				}
+			}
+			find(child)
+		}
+	}
+	find(root)
+
+	// Register all components before compiling any, so they can refer to each other
+	defined := make(map[string]bool)
+	comps := make([]*component, len(defs))
+	for i, def := range defs {
+		name, ok := getAttr(def, "name")
+		name = strings.ToLower(name)
+		switch {
+		case !ok:
+			c.fail(def, "name", "", errMissingAttr)
+			continue
+		case builtins[name]:
+			c.fail(def, "name", "", fmt.Errorf("cannot define built-in element <%s>", name))
+			continue
+		case defined[name]:
+			c.fail(def, "name", "", fmt.Errorf("component %q is already defined", name))
+			continue
+		}
+		defined[name] = true
+		comps[i] = &component{name: name}
+		c.components[name] = comps[i]
+	}
+	for i, def := range defs {
+		if comps[i] != nil {
+			comps[i].prog = c.children(def)
+		}
+	}
+}
+
+// call compiles a use of a component.
+// Children of the element with a slot attribute are placed into the slot with that name, and other children into the unnamed slot.
+func (c *compiler) call(comp *component, node *html.Node) []instr {
+	in := &componentInstr{comp: comp, slots: make(map[string][]instr)}
+	for _, attr := range node.Attr {
+		// As with ordinary elements, attributes with a "v:" prefix contain a variable path, and others are strings
+		if key := strings.TrimPrefix(attr.Key, "v:"); key != attr.Key {
+			in.attrs = append(in.attrs, componentAttr{key, c.expr(node, attr.Key, attr.Val)})
+		} else if attr.Key != "slot" {
+			in.attrs = append(in.attrs, componentAttr{attr.Key, &literalExpr{reflect.ValueOf(attr.Val)}})
+		}
+	}
+
+	content := make(map[string][]*html.Node)
+	filled := make(map[string]bool)
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		name := ""
+		if child.Type == html.ElementNode {
+			name, _ = getAttr(child, "slot")
+		}
+		// Slots containing only whitespace and comments are considered empty
+		if !isBlank(child) {
+			filled[name] = true
+		}
+		content[name] = append(content[name], child)
+	}
+	for name, nodes := range content {
+		if filled[name] {
+			in.slots[name] = c.sequence(nodes)
+		}
+	}
+	return []instr{in}
+}
+
+// extends compiles the layout referenced by an <extends> element, replacing its blocks with those within the element
+func (c *compiler) extends(node *html.Node) []instr {
+	src, ok := getAttr(node, "src")
+	if !ok {
+		c.fail(node, "src", "", errMissingAttr)
+		return nil
+	}
+	layout, err := c.config.load(src, c.stack)
+	if err != nil {
+		if herr, ok := err.(*Error); ok && c.err == nil {
+			// Report problems within the layout directly
+			c.err = herr
+		}
+		c.fail(node, "src", "", err)
+		return nil
+	}
+
+	var blocks []*override
+	overrides := make(map[string]*override)
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.Type == html.ElementNode && child.Data == "block":
+			name, ok := getAttr(child, "name")
+			if !ok {
+				c.fail(child, "name", "", errMissingAttr)
+				continue
+			}
+			o := &override{node: child, file: c.file}
+			blocks = append(blocks, o)
+			overrides[name] = o
+		case isBlank(child):
+		default:
+			c.fail(child, "", "", errors.New("<extends> may only contain <block> elements"))
+		}
+	}
+	// Overrides from templates extending this one take precedence
+	for name, o := range c.overrides {
+		overrides[name] = o
+	}
+
+	prog := c.sub(layout.file, layout.node, overrides)
+	for _, o := range blocks {
+		name, _ := getAttr(o.node, "name")
+		// Blocks replaced by another override are defined if their replacement was used
+		if !overrides[name].used {
+			c.fail(o.node, "name", "", fmt.Errorf("block %q is not defined in %q", name, src))
+		}
+	}
+	return prog
+}
+
+// children compiles all children of a given node
+func (c *compiler) children(node *html.Node) []instr {
+	var nodes []*html.Node
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		nodes = append(nodes, child)
+	}
+	return c.sequence(nodes)
+}
+
+// sequence compiles a sequence of sibling nodes.
+// <elif> and <else> elements following a conditional element are compiled as branches of it, ignoring whitespace and comments between them.
+func (c *compiler) sequence(nodes []*html.Node) (prog []instr) {
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+		if node.Type != html.ElementNode || node.Data != "if" && node.Data != "nif" {
+			prog = append(prog, c.compile(node)...)
+			continue
+		}
+
+		var branches []*html.Node
+		for j := i + 1; j < len(nodes); j++ {
+			if isBranch(nodes[j]) {
+				branches = append(branches, nodes[j])
+				i = j
+			} else if !isBlank(nodes[j]) {
+				break
+			}
+		}
+		prog = append(prog, c.cond(node, branches))
+	}
+	return
+}
+
+// cond compiles a conditional element.
+// Its branches are the <elif> and <else> elements at the end of its body, followed by the given sibling branches.
+func (c *compiler) cond(node *html.Node, siblings []*html.Node) *ifInstr {
+	var body, branches []*html.Node
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case isBranch(child):
+			branches = append(branches, child)
+		case len(branches) == 0:
+			body = append(body, child)
+		case !isBlank(child):
+			c.fail(node, "", "", fmt.Errorf("<%s> must not contain content after <%s>", node.Data, branches[len(branches)-1].Data))
+		}
+	}
+
+	in := &ifInstr{
+		cond:   c.attr(node, "v"),
+		negate: node.Data == "nif",
+		body:   c.sequence(body),
+	}
+	last := in
+	for _, branch := range append(branches, siblings...) {
+		if last == nil {
+			c.fail(branch, "", "", fmt.Errorf("<%s> must not follow <else>", branch.Data))
+			break
+		}
+		if branch.Data == "else" {
+			last.els = c.children(branch)
+			last = nil
+		} else {
+			next := &ifInstr{cond: c.attr(branch, "v"), body: c.children(branch)}
+			last.els = []instr{next}
+			last = next
+		}
+	}
+	return in
+}
+
+// switch_ compiles a <switch> element
+func (c *compiler) switch_(node *html.Node) *switchInstr {
+	in := &switchInstr{val: c.attr(node, "v")}
+	hasDefault := false
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.Type == html.ElementNode && child.Data == "case":
+			cs := caseInstr{body: c.children(child)}
+			if is, ok := getAttr(child, "is"); ok {
+				cs.literal, cs.is = true, is
+			} else if _, ok := getAttr(child, "v"); ok {
+				cs.val = c.attr(child, "v")
+			} else {
+				c.fail(child, "is", "", errMissingAttr)
+				continue
+			}
+			in.cases = append(in.cases, cs)
+		case child.Type == html.ElementNode && child.Data == "default":
+			if hasDefault {
+				c.fail(child, "", "", errors.New("<switch> must not contain multiple <default> elements"))
+			}
+			hasDefault = true
+			in.def = c.children(child)
+		case isBlank(child):
+		default:
+			c.fail(child, "", "", errors.New("<switch> may only contain <case> and <default> elements"))
+		}
+	}
+	return in
+}
+
+// isBranch returns true if a node is an <elif> or <else> element
+func isBranch(node *html.Node) bool {
+	return node.Type == html.ElementNode && (node.Data == "elif" || node.Data == "else")
+}
+
+// isBlank returns true if a node is a comment or whitespace
+func isBlank(node *html.Node) bool {
+	return node.Type == html.CommentNode || node.Type == html.TextNode && strings.TrimSpace(node.Data) == ""
+}
+
+// isStatic returns true if a sequence of instructions contains only static nodes
+func isStatic(prog []instr) bool {
+	for _, in := range prog {
+		if _, ok := in.(*staticInstr); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// rawText compiles the content of a <script v> or <style v> element, substituting the <v> elements within its text.
+// Each value is escaped according to its context in the JavaScript or CSS.
+func (c *compiler) rawText(node *html.Node) []instr {
+	child := node.FirstChild
+	if child == nil || child.NextSibling != nil || child.Type != html.TextNode {
+		return c.children(node)
+	}
+	parts, err := htmlcontext.Split(node.Data, child.Data)
+	if err != nil {
+		c.fail(node, "", "", err)
+		return nil
+	}
+	prog := make([]instr, len(parts))
+	for i, part := range parts {
+		if part.Path == "" {
+			prog[i] = newStaticInstr(&html.Node{Type: html.TextNode, Data: part.Text})
+		} else {
+			prog[i] = &vInstr{val: c.expr(node, "", part.Path), ctx: part.Context}
+		}
+	}
+	return prog
+}
+
+// withoutAttr removes the static attribute with the given name
+func withoutAttr(attrs []attrInstr, key string) []attrInstr {
+	ret := attrs[:0:0]
+	for _, attr := range attrs {
+		if attr.val != nil || attr.attr.Namespace != "" || attr.attr.Key != key {
+			ret = append(ret, attr)
+		}
+	}
+	return ret
+}
+
+// attrs compiles the attributes of an ordinary element.
+// Attributes with a "v:" prefix contain a variable path, the value of which is substituted into the attribute.
+func (c *compiler) attrs(node *html.Node) (attrs []attrInstr, dynamic bool) {
+	for _, attr := range node.Attr {
+		key := strings.TrimPrefix(attr.Key, "v:")
+		if key == attr.Key {
+			attrs = append(attrs, attrInstr{attr: attr})
+			continue
+		}
+		dynamic = true
+		attrs = append(attrs, attrInstr{
+			attr: html.Attribute{Namespace: attr.Namespace, Key: key},
+			val:  c.expr(node, attr.Key, attr.Val),
+			ctx:  AttrContext(key),
+		})
+	}
+	return
+}
+
+// attr compiles the variable path contained in the given attribute of a node
+func (c *compiler) attr(node *html.Node, key string) expr {
+	src, ok := getAttr(node, key)
+	if !ok {
+		c.fail(node, key, "", errMissingAttr)
+		return nil
+	}
+	return c.expr(node, key, src)
+}
+func getAttr(node *html.Node, key string) (string, bool) {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+// bound compiles an attribute containing a bound of a numeric range, returning nil if the attribute is not present
+func (c *compiler) bound(node *html.Node, attr string) *boundExpr {
+	src, ok := getAttr(node, attr)
+	if !ok {
+		return nil
+	}
+	return &boundExpr{&source{c.file, node, attr, src}, c.expr(node, attr, src)}
+}
+
+// expr parses an expression. If the expression is invalid, nil is returned.
+func (c *compiler) expr(node *html.Node, attr, src string) expr {
+	p := &exprParser{text: src, source: &source{c.file, node, attr, src}, config: c.config}
+	e, err := p.parse()
+	if err != nil {
+		c.fail(node, attr, src, err)
+		return nil
+	}
+	return e
+}
+
+// parse parses the text of a path into p.
+// If nested is true, the path is inside brackets and parsing stops at the closing ']'.
+func (p *path) parse(text string, nested bool) (rest string, err error) {
+	if text == "" {
+		if nested {
+			return "", errors.New("unmatched '['")
+		}
+		return "", errors.New("empty variable path")
+	}
+
+	// Parse the head variable name
+	if text[0] == '.' {
+		p.head = "."
+		text = text[1:]
+		if text != "" && strings.IndexByte(".[]", text[0]) < 0 {
+			// The leading dot of .foo is both the variable name and the key separator
+			text = "." + text
+		}
+	} else {
+		idx := strings.IndexAny(text, ".[]")
+		if idx < 0 {
+			idx = len(text)
+		}
+		p.head, text = text[:idx], text[idx:]
+		if p.head == "" {
+			return "", errors.New("empty variable name")
+		}
+	}
+
+	// Parse the keys
+	for text != "" {
+		sep := text[0]
+		text = text[1:]
+		switch sep {
+		case '.':
+			idx := strings.IndexAny(text, ".[]")
+			if idx < 0 {
+				idx = len(text)
+			}
+			if idx == 0 {
+				return "", errors.New("empty key")
+			}
+			p.keys = append(p.keys, &pathKey{name: text[:idx]})
+			text = text[idx:]
+
+		case '[':
+			sub := &path{source: p.source, tags: p.tags}
+			text, err = sub.parse(text, true)
+			if err != nil {
+				return "", err
+			}
+			p.keys = append(p.keys, &pathKey{path: sub})
+
+		case ']':
+			if nested {
+				return text, nil
+			} else {
+				return "", errors.New("unmatched ']'")
+			}
+		}
+	}
+
+	if nested {
+		return "", errors.New("unmatched '['")
+	}
+	return "", nil
+}
@@ -0,0 +1,63 @@
+package htmpl
+
+import (
+	"strings"
+
+	"github.com/vktec/htmpl/internal/htmlcontext"
+	"golang.org/x/net/html"
+)
+
+// A Context is the part of an HTML document that a value is substituted into, which determines how it is escaped.
+// Contexts are determined when a template is compiled, as html/template does.
+type Context = htmlcontext.Context
+
+const (
+	ContextText      = htmlcontext.Text      // Element content or an ordinary attribute, which are escaped when rendered
+	ContextURL       = htmlcontext.URL       // An attribute containing a URL, such as href
+	ContextJS        = htmlcontext.JS        // A JavaScript expression, in a <script> element or an event handler attribute
+	ContextJSString  = htmlcontext.JSString  // A JavaScript string or template literal
+	ContextJSRegexp  = htmlcontext.JSRegexp  // A JavaScript regular expression literal
+	ContextCSS       = htmlcontext.CSS       // A CSS value, in a <style> element or a style attribute
+	ContextCSSString = htmlcontext.CSSString // A CSS string
+	ContextCSSURL    = htmlcontext.CSSURL    // A CSS url(...) value, quoted or unquoted
+	ContextComment   = htmlcontext.Comment   // A JavaScript or CSS comment, in which values are omitted
+	ContextHTML      = htmlcontext.HTML      // An attribute containing an HTML document, such as srcdoc, in which values are escaped twice
+)
+
+// AttrContext returns the context of a value substituted into the attribute with the given name
+func AttrContext(key string) Context {
+	key = strings.ToLower(key)
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		if key[:i] == "xmlns" {
+			return ContextURL
+		}
+		key = key[i+1:]
+	}
+	// Custom data attributes are treated like the attributes they are named after, as they are often copied to them by scripts
+	key = strings.TrimPrefix(key, "data-")
+	switch {
+	case key == "srcdoc":
+		return ContextHTML
+	case strings.HasPrefix(key, "on"):
+		return ContextJS
+	case key == "style":
+		return ContextCSS
+	case urlAttrs[key] || strings.Contains(key, "src") || strings.Contains(key, "uri") || strings.Contains(key, "url"):
+		return ContextURL
+	}
+	return ContextText
+}
+
+// isRawText returns true if a node is a <script v> or <style v> element, whose text may contain <v> elements.
+// The content of other raw text elements is never substituted, as it cannot be escaped.
+func isRawText(node *html.Node) bool {
+	if node.Type != html.ElementNode || node.Data != "script" && node.Data != "style" {
+		return false
+	}
+	for _, attr := range node.Attr {
+		if attr.Namespace == "" && attr.Key == "v" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package htmpl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vktec/htmpl/internal/htmlpos"
+	"golang.org/x/net/html"
+)
+
+// An Error describes a problem found while evaluating a template, or generating code for it
+type Error struct {
+	Name string     // The name of the template in which the problem was found, if known
+	Node *html.Node // The node in which the problem was found
+	Attr string     // The attribute in which the problem was found, if any
+	Path string     // The variable path in which the problem was found, if any
+
+	// The position of Node in the template source, if known.
+	// Line and Col are 1-based; if the position is unknown they are 0.
+	Line, Col int
+
+	Err error // The underlying error
+}
+
+var errMissingAttr = errors.New("missing attribute")
+
+func (e *Error) Error() string {
+	b := strings.Builder{}
+	if e.Name != "" {
+		b.WriteString(e.Name)
+		b.WriteByte(':')
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d:", e.Line, e.Col)
+	}
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	if e.Node != nil && e.Node.Type == html.ElementNode {
+		fmt.Fprintf(&b, "<%s> ", e.Node.Data)
+	}
+	if e.Attr != "" {
+		fmt.Fprintf(&b, "attribute %q ", e.Attr)
+	}
+	if e.Path != "" {
+		fmt.Fprintf(&b, "path %q", e.Path)
+	}
+	return strings.TrimSuffix(b.String(), " ") + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// A file describes the source of a template
+type file struct {
+	name string
+	pos  map[*html.Node]htmlpos.Position
+}
+
+func (f *file) error(node *html.Node, attr, path string, err error) *Error {
+	p := f.pos[node]
+	return &Error{
+		Name: f.name,
+		Node: node,
+		Attr: attr,
+		Path: path,
+		Line: p.Line,
+		Col:  p.Col,
+		Err:  err,
+	}
+}
@@ -0,0 +1,86 @@
+package htmpl
+
+import (
+	"errors"
+	"testing"
+)
+
+func testErr(t *testing.T, dot interface{}, input, expected string) {
+	t.Helper()
+	_, err := EvaluateSource([]byte(input), dot)
+	if err == nil {
+		t.Errorf("Expected error %q, received nil", expected)
+		return
+	}
+	var herr *Error
+	if !errors.As(err, &herr) {
+		t.Errorf("Expected *Error, received %T", err)
+		return
+	}
+	if err.Error() != expected {
+		t.Errorf("Expected and actual error do not match:\n\tExpected: %q\n\tReceived: %q", expected, err.Error())
+	}
+}
+
+type failing struct{}
+
+func (failing) Value() (string, error) { return "", errors.New("failed") }
+
+// Problems in templates should be reported with their location
+func TestErrors(t *testing.T) {
+	type testData struct {
+		Foo string
+	}
+	testErr(t, testData{}, `<p><v>.Bar</v></p>`, `1:4: <v> path ".Bar": no field "Bar" in type htmpl.testData`)
+	testErr(t, methodUser{}, `<v>.Greet</v>`, `1:1: <v> path ".Greet": no field "Greet" in type htmpl.methodUser`)
+	testErr(t, map[string]interface{}{"x": failing{}}, `<v>.x.Value</v>`, `1:1: <v> path ".x.Value": calling method "Value": failed`)
+	testErr(t, embeddedData{}, `<v>.Name</v>`, `1:1: <v> path ".Name": no field "Name" in type htmpl.embeddedData`)
+	testErr(t, nil, "<div>\n\t<if v=\"foo\">x</if>\n</div>", `2:2: <if> attribute "v" path "foo": undefined variable "foo"`)
+	testErr(t, nil, "<div>\n  <nif>x</nif>\n</div>", `2:3: <nif> attribute "v": missing attribute`)
+	testErr(t, nil, "<!-- <for v=\"bad\"> -->\n<a title=\"<for>\"></a><for v=\".[\">x</for>", `2:22: <for> attribute "v" path ".[": unmatched '['`)
+	testErr(t, nil, "<script>\n<if>\n</script>\n<let var=\"x\" val=\".]\"></let>", `4:1: <let> attribute "val" path ".]": unmatched ']'`)
+	testErr(t, nil, "<A V:HREF=\"a]\"></A>", `1:1: <a> attribute "v:href" path "a]": unmatched ']'`)
+	testErr(t, nil, `<v></v>`, `1:1: <v>: <v> must contain a variable path`)
+	testErr(t, nil, "<p></p><script v>var x = <v>.x;</script>", `1:8: <script>: <v> must be closed by </v>`)
+	testErr(t, nil, "<style v>p { color: <v>.x]</v> }</style>", `1:1: <style> path ".x]": unmatched ']'`)
+	testErr(t, nil, "<p>\n<else>x</else></p>", `2:1: <else>: <else> must follow <if>, <nif> or <elif>`)
+	testErr(t, nil, `<if v="."><else>x</else><elif v=".">y</elif></if>`, `1:25: <elif>: <elif> must not follow <else>`)
+	testErr(t, nil, `<if v="."><else>x</else>y</if>`, `1:1: <if>: <if> must not contain content after <else>`)
+	testErr(t, nil, `<if v=".a ==">x</if>`, `1:1: <if> attribute "v" path ".a ==": missing operand`)
+	testErr(t, nil, `<let var="loop" val=".">x</let>`, `1:1: <let> attribute "var": variable "loop" is reserved`)
+	testErr(t, nil, `<for v="." val="loop">x</for>`, `1:1: <for> attribute "val": variable "loop" is reserved`)
+	testErr(t, nil, `<for v="." to="3">x</for>`, `1:1: <for>: <for> must not have both v and to attributes`)
+	testErr(t, nil, `<for from="1">x</for>`, `1:1: <for> attribute "to": missing attribute`)
+	testErr(t, nil, `<for to="3" step="0">x</for>`, `1:1: <for> attribute "step" path "0": step must not be zero`)
+	testErr(t, nil, `<for to="2.5">x</for>`, `1:1: <for> attribute "to" path "2.5": 2.5 is not an integer`)
+	testErr(t, map[string]uint64{"n": 1 << 63}, `<for to=".n">x</for>`, `1:1: <for> attribute "to" path ".n": 9223372036854775808 is out of range`)
+	testErr(t, nil, `<for from="-1e300" to="1">x</for>`, `1:1: <for> attribute "from" path "-1e300": -1e+300 is out of range`)
+	testErr(t, nil, `<if v="(.a">x</if>`, `1:1: <if> attribute "v" path "(.a": unmatched '('`)
+	testErr(t, nil, `<if v=".a .b">x</if>`, `1:1: <if> attribute "v" path ".a .b": unexpected ".b"`)
+	testErr(t, nil, `<if v="'a">x</if>`, `1:1: <if> attribute "v" path "'a": unterminated string`)
+	testErr(t, nil, `<if v="1x">x</if>`, `1:1: <if> attribute "v" path "1x": invalid number "1x"`)
+	testErr(t, nil, `<if v="1 < .a < 2">x</if>`, `1:1: <if> attribute "v" path "1 < .a < 2": unexpected "< 2"`)
+	testErr(t, nil, `<case is="x"></case>`, `1:1: <case>: <case> must be within <switch>`)
+	testErr(t, nil, `<switch v="."><case></case></switch>`, `1:15: <case> attribute "is": missing attribute`)
+	testErr(t, nil, `<switch v="."><p></p></switch>`, `1:15: <p>: <switch> may only contain <case> and <default> elements`)
+	testErr(t, nil, `<define name="For"></define>`, `1:1: <define> attribute "name": cannot define built-in element <for>`)
+	testErr(t, nil, "<define name=\"x\"></define>\n<define name=\"x\"></define>", `2:1: <define> attribute "name": component "x" is already defined`)
+	testErr(t, nil, `<define name="x"><v>y</v></define><x></x>`, `1:18: <v> path "y": undefined variable "y"`)
+}
+
+// Valid templates should not produce errors
+func TestNoErrors(t *testing.T) {
+	type testData struct {
+		Foo  string
+		Bar  []int
+		Baz  map[string]int
+		Quux *testData
+	}
+	_, err := EvaluateSource([]byte(`
+		<v>.Foo</v> <v>.Bar.7</v> <v>.Baz.missing</v> <v>.Quux.Foo</v> <v>.Foo.x</v>
+		<let var="x" val=".Foo"><v>x</v></let>
+	`), testData{})
+	if err != nil {
+		t.Error(err)
+	}
+}
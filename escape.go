@@ -0,0 +1,304 @@
+package htmpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vktec/htmpl/internal/htmlcontext"
+	"golang.org/x/net/html"
+)
+
+// urlAttrs is the set of attributes whose values are interpreted as URLs
+var urlAttrs = map[string]bool{
+	"action":     true,
+	"archive":    true,
+	"background": true,
+	"cite":       true,
+	"classid":    true,
+	"codebase":   true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"icon":       true,
+	"longdesc":   true,
+	"manifest":   true,
+	"poster":     true,
+	"profile":    true,
+	"src":        true,
+	"usemap":     true,
+	"xmlns":      true,
+}
+
+// unsafeURL replaces URLs with unsafe schemes, such as javascript:
+const unsafeURL = "#ZgotmplZ"
+
+// unsafeCSS replaces CSS values that could change the meaning of the surrounding CSS
+const unsafeCSS = "ZgotmplZ"
+
+// EscapeAttr escapes val for use as the value of the attribute named key.
+// HTML special characters are not escaped, as they are handled when the attribute is rendered.
+func EscapeAttr(key, val string) string {
+	return Escape(AttrContext(key), val)
+}
+
+// Escape converts a value to a string and escapes it for use in the given context.
+// HTML special characters are not escaped, as they are handled when the value is rendered.
+func Escape(ctx Context, v interface{}) string {
+	return escape(ctx, reflect.ValueOf(v))
+}
+
+func escape(ctx Context, v reflect.Value) string {
+	if tctx, s, ok := trusted(v); ok {
+		switch {
+		case tctx == ContextURL && ctx == ContextURL:
+			return normalizeURL(s)
+		case tctx == ContextURL && ctx == ContextCSSURL:
+			return escapeCSS(normalizeURL(s))
+		case tctx == ctx && (ctx == ContextJS || ctx == ContextCSS), tctx == ContextText && ctx == ContextHTML:
+			return s
+		}
+	}
+	switch ctx {
+	case ContextURL:
+		return escapeURL(stringify(v))
+	case ContextJS:
+		return escapeJSValue(v)
+	case ContextJSString:
+		return escapeJSString(stringify(v))
+	case ContextJSRegexp:
+		return escapeJSRegexp(stringify(v))
+	case ContextCSS:
+		return filterCSS(stringify(v))
+	case ContextCSSString:
+		return escapeCSS(stringify(v))
+	case ContextCSSURL:
+		return escapeCSS(escapeURL(stringify(v)))
+	case ContextComment:
+		return ""
+	case ContextHTML:
+		// The attribute is escaped again when rendered, so the document contains the value as text
+		return html.EscapeString(stringify(v))
+	default:
+		return stringify(v)
+	}
+}
+
+// escapeURL filters out URLs with unsafe schemes and percent-encodes any characters not permitted in a URL
+func escapeURL(s string) string {
+	if i := strings.IndexAny(s, ":/?#"); i >= 0 && s[i] == ':' {
+		switch strings.ToLower(s[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return unsafeURL
+		}
+	}
+	return normalizeURL(s)
+}
+
+// normalizeURL percent-encodes any characters not permitted in a URL
+func normalizeURL(s string) string {
+	b := strings.Builder{}
+	written := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			continue
+		case strings.IndexByte("-._~!#$&*+,/:;=?@[]", c) >= 0:
+			continue
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			// Don't re-encode existing escapes
+			continue
+		}
+		b.WriteString(s[written:i])
+		fmt.Fprintf(&b, "%%%02X", c)
+		written = i + 1
+	}
+	if written == 0 {
+		return s
+	}
+	b.WriteString(s[written:])
+	return b.String()
+}
+
+// escapeJSValue converts a value to a JavaScript expression, by encoding it as JSON.
+// The encoding escapes <, > and &, so the result cannot end a <script> element.
+func escapeJSValue(v reflect.Value) string {
+	b, err := json.Marshal(iface(v))
+	if err != nil {
+		// The error message is not included, as it may contain the end of a comment
+		return " /* error */ null "
+	}
+	if len(b) > 0 && (htmlcontext.IsJSIdentPart(b[0]) || htmlcontext.IsJSIdentPart(b[len(b)-1])) {
+		// Separate values from adjacent identifiers and numbers, and prevent them from forming -- or ++ with adjacent operators
+		return " " + string(b) + " "
+	}
+	return string(b)
+}
+
+// jsStringReplacements contains the escape sequences of characters in JavaScript strings
+var jsStringReplacements = map[rune]string{
+	0:        `\u0000`,
+	'\t':     `\t`,
+	'\n':     `\n`,
+	'\v':     `\u000b`,
+	'\f':     `\f`,
+	'\r':     `\r`,
+	'"':      `\u0022`,
+	'$':      `\u0024`,
+	'&':      `\u0026`,
+	'\'':     `\u0027`,
+	'+':      `\u002b`,
+	'/':      `\/`,
+	'<':      `\u003c`,
+	'>':      `\u003e`,
+	'\\':     `\\`,
+	'`':      `\u0060`,
+	'\u2028': `\u2028`,
+	'\u2029': `\u2029`,
+}
+
+// jsRegexpReplacements contains the additional escape sequences of characters in JavaScript regular expressions
+var jsRegexpReplacements = map[rune]string{
+	'$': `\$`,
+	'(': `\(`,
+	')': `\)`,
+	'*': `\*`,
+	'-': `\-`,
+	'.': `\.`,
+	'?': `\?`,
+	'[': `\[`,
+	']': `\]`,
+	'^': `\^`,
+	'{': `\{`,
+	'|': `\|`,
+	'}': `\}`,
+}
+
+// escapeJSString escapes a string for use within a JavaScript string or template literal
+func escapeJSString(s string) string {
+	return replace(s, func(r rune) string {
+		if repl, ok := jsStringReplacements[r]; ok {
+			return repl
+		}
+		if r < ' ' {
+			return fmt.Sprintf(`\u%04x`, r)
+		}
+		return ""
+	})
+}
+
+// escapeJSRegexp escapes a string for use within a JavaScript regular expression, so it matches itself literally
+func escapeJSRegexp(s string) string {
+	if s == "" {
+		// Prevent the value from forming a comment
+		return "(?:)"
+	}
+	return replace(s, func(r rune) string {
+		if repl, ok := jsRegexpReplacements[r]; ok {
+			return repl
+		}
+		if repl, ok := jsStringReplacements[r]; ok {
+			return repl
+		}
+		if r < ' ' {
+			return fmt.Sprintf(`\u%04x`, r)
+		}
+		return ""
+	})
+}
+
+// filterCSS replaces CSS values that could change the meaning of the surrounding CSS, such as those containing quotes or semicolons
+func filterCSS(s string) string {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 0, '"', '\'', '(', ')', '/', ';', '@', '[', '\\', ']', '`', '{', '}', '<', '>':
+			return unsafeCSS
+		case '-':
+			// Prevent the value from forming --> or a comment
+			if i > 0 && s[i-1] == '-' {
+				return unsafeCSS
+			}
+		}
+	}
+	lower := strings.ToLower(s)
+	if strings.Contains(lower, "expression") || strings.Contains(lower, "mozbinding") {
+		return unsafeCSS
+	}
+	return s
+}
+
+// cssReplacements contains the escape sequences of characters in CSS strings
+var cssReplacements = map[rune]string{
+	0:    `\0`,
+	'\t': `\9`,
+	'\n': `\a`,
+	'\f': `\c`,
+	'\r': `\d`,
+	'"':  `\22`,
+	'&':  `\26`,
+	'\'': `\27`,
+	'(':  `\28`,
+	')':  `\29`,
+	'+':  `\2b`,
+	'/':  `\2f`,
+	':':  `\3a`,
+	';':  `\3b`,
+	'<':  `\3c`,
+	'>':  `\3e`,
+	'\\': `\\`,
+	'{':  `\7b`,
+	'}':  `\7d`,
+}
+
+// escapeCSS escapes a string for use within a CSS string or url(...) value
+func escapeCSS(s string) string {
+	b := strings.Builder{}
+	written := 0
+	for i, r := range s {
+		repl, ok := cssReplacements[r]
+		if !ok {
+			if r >= ' ' {
+				continue
+			}
+			repl = fmt.Sprintf(`\%x`, r)
+		}
+		b.WriteString(s[written:i])
+		b.WriteString(repl)
+		written = i + utf8.RuneLen(r)
+		// Hexadecimal escapes are terminated by a space if they could be followed by a hex digit or space
+		if repl != `\\` && (written == len(s) || isHex(s[written]) || strings.IndexByte(" \t\n\f\r", s[written]) >= 0) {
+			b.WriteByte(' ')
+		}
+	}
+	if written == 0 {
+		return s
+	}
+	b.WriteString(s[written:])
+	return b.String()
+}
+
+// replace replaces each rune of s for which repl returns a non-empty string
+func replace(s string, repl func(r rune) string) string {
+	b := strings.Builder{}
+	written := 0
+	for i, r := range s {
+		if rs := repl(r); rs != "" {
+			b.WriteString(s[written:i])
+			b.WriteString(rs)
+			written = i + utf8.RuneLen(r)
+		}
+	}
+	if written == 0 {
+		return s
+	}
+	b.WriteString(s[written:])
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
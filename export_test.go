@@ -0,0 +1,44 @@
+package htmpl
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// A FragCase is a template checked by testFrag, with the value of dot and the expected output.
+// The cases are exported for the parity test in parity_test.go, which runs them against generated code outside this package.
+type FragCase struct {
+	Name   string // The name of the test, and the index of the case within it
+	Dot    interface{}
+	Input  string // The template, which is parsed by html.ParseFragment
+	Output string
+}
+
+type fragRecorder struct {
+	cases []FragCase
+	count map[string]int
+}
+
+// fragCases records the cases checked by testFrag, if not nil
+var fragCases *fragRecorder
+
+func (r *fragRecorder) add(t *testing.T, dot interface{}, input, output string) {
+	name := t.Name()
+	r.cases = append(r.cases, FragCase{fmt.Sprintf("%s#%d", name, r.count[name]), dot, input, output})
+	r.count[name]++
+}
+
+// TestMain records the cases checked by every test using testFrag, so TestParity checks them without a list of those tests
+func TestMain(m *testing.M) {
+	fragCases = &fragRecorder{count: map[string]int{}}
+	os.Exit(m.Run())
+}
+
+// FragCases returns the cases checked by testFrag since it was last called.
+// The tests of this package run before the external tests, so TestParity sees the cases of every test selected to run.
+func FragCases() []FragCase {
+	cases := fragCases.cases
+	fragCases = &fragRecorder{count: map[string]int{}}
+	return cases
+}
@@ -0,0 +1,507 @@
+package htmpl
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// An expr is a parsed expression: a *path, *literalExpr, *notExpr, *binaryExpr or *callExpr.
+// A nil expr evaluates to empty.
+type expr interface{}
+
+// literalExpr is a string or number literal
+type literalExpr struct {
+	val reflect.Value
+}
+
+// notExpr is true iff its operand is falsey
+type notExpr struct {
+	x expr
+}
+
+// binaryExpr applies a comparison or boolean operator to two operands
+type binaryExpr struct {
+	op   string
+	x, y expr
+}
+
+// callExpr calls a function. The first argument is the value piped into the function.
+type callExpr struct {
+	*source
+	name string
+	fn   reflect.Value
+	args []expr
+}
+
+// exprParser parses an expression.
+//
+// The grammar is as follows, where path is a variable path not containing whitespace, quotes, parentheses, pipes or comparison operators:
+//
+//	pipe    = or { "|" name { operand } }
+//	or      = and { "or" and }
+//	and     = not { "and" not }
+//	not     = "not" not | cmp
+//	cmp     = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand ]
+//	operand = "(" pipe ")" | string | number | path
+type exprParser struct {
+	text   string // The remaining text to parse
+	source *source
+	config *Config // Used to look up functions
+}
+
+func (p *exprParser) parse() (expr, error) {
+	if strings.TrimSpace(p.text) == "" {
+		return nil, errors.New("empty variable path")
+	}
+	e, err := p.pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.text != "" {
+		return nil, fmt.Errorf("unexpected %q", p.text)
+	}
+	return e, nil
+}
+
+func (p *exprParser) pipe() (expr, error) {
+	x, err := p.or()
+	for err == nil && p.next('|') {
+		p.space()
+		end := 0
+		for end < len(p.text) && isNameChar(p.text[end]) {
+			end++
+		}
+		if end == 0 {
+			return nil, errors.New("missing function name after '|'")
+		}
+		call := &callExpr{source: p.source, name: p.text[:end], args: []expr{x}}
+		p.text = p.text[end:]
+		if call.fn, err = p.config.function(call.name); err != nil {
+			return nil, err
+		}
+
+		for {
+			p.space()
+			if p.text == "" || p.text[0] == '|' || p.text[0] == ')' {
+				break
+			}
+			var arg expr
+			if arg, err = p.operand(); err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+
+		t := call.fn.Type()
+		if n := len(call.args); t.IsVariadic() && n < t.NumIn()-1 {
+			return nil, fmt.Errorf("wrong number of arguments to %q: expected at least %d, received %d", call.name, t.NumIn()-1, n)
+		} else if !t.IsVariadic() && n != t.NumIn() {
+			return nil, fmt.Errorf("wrong number of arguments to %q: expected %d, received %d", call.name, t.NumIn(), n)
+		}
+		x = call
+	}
+	return x, err
+}
+func (p *exprParser) or() (expr, error) {
+	x, err := p.and()
+	for err == nil && p.keyword("or") {
+		var y expr
+		y, err = p.and()
+		x = &binaryExpr{"or", x, y}
+	}
+	return x, err
+}
+
+func (p *exprParser) and() (expr, error) {
+	x, err := p.not()
+	for err == nil && p.keyword("and") {
+		var y expr
+		y, err = p.not()
+		x = &binaryExpr{"and", x, y}
+	}
+	return x, err
+}
+
+func (p *exprParser) not() (expr, error) {
+	if p.keyword("not") {
+		x, err := p.not()
+		return &notExpr{x}, err
+	}
+	return p.cmp()
+}
+
+func (p *exprParser) cmp() (expr, error) {
+	x, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(p.text, op) {
+			p.text = p.text[len(op):]
+			y, err := p.operand()
+			return &binaryExpr{op, x, y}, err
+		}
+	}
+	return x, nil
+}
+
+func (p *exprParser) operand() (expr, error) {
+	p.space()
+	if p.text == "" {
+		return nil, errors.New("missing operand")
+	}
+	switch c := p.text[0]; {
+	case c == '(':
+		p.text = p.text[1:]
+		x, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		p.space()
+		if !strings.HasPrefix(p.text, ")") {
+			return nil, errors.New("unmatched '('")
+		}
+		p.text = p.text[1:]
+		return x, nil
+
+	case c == '"' || c == '\'':
+		return p.string()
+
+	case isDigit(c) || c == '-' && len(p.text) > 1 && isDigit(p.text[1]):
+		return p.number()
+
+	case strings.IndexByte(")=!<>|", c) >= 0:
+		return nil, fmt.Errorf("unexpected %q", p.text)
+
+	default:
+		end := strings.IndexAny(p.text, " \t\r\n()=!<>\"'|")
+		if end < 0 {
+			end = len(p.text)
+		}
+		path := &path{source: p.source, tags: p.config.StructTags}
+		rest, err := path.parse(p.text[:end], false)
+		if err == nil && rest != "" {
+			err = errors.New("unmatched ']'")
+		}
+		p.text = p.text[end:]
+		return path, err
+	}
+}
+
+// string parses a string literal, delimited by single or double quotes.
+// A backslash causes the following character to be included literally.
+func (p *exprParser) string() (expr, error) {
+	quote := p.text[0]
+	b := strings.Builder{}
+	for i := 1; i < len(p.text); i++ {
+		switch c := p.text[i]; {
+		case c == '\\' && i+1 < len(p.text):
+			i++
+			b.WriteByte(p.text[i])
+		case c == quote:
+			p.text = p.text[i+1:]
+			return &literalExpr{reflect.ValueOf(b.String())}, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, errors.New("unterminated string")
+}
+
+// number parses a decimal number literal, which is an int unless it contains a fraction or exponent
+func (p *exprParser) number() (expr, error) {
+	end := 1
+	for end < len(p.text) && strings.IndexByte(" \t\r\n()=!<>|", p.text[end]) < 0 {
+		end++
+	}
+	text := p.text[:end]
+	p.text = p.text[end:]
+	if n, err := strconv.Atoi(text); err == nil {
+		return &literalExpr{reflect.ValueOf(n)}, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil && !strings.ContainsAny(text, "xXpP_") {
+		return &literalExpr{reflect.ValueOf(f)}, nil
+	}
+	return nil, fmt.Errorf("invalid number %q", text)
+}
+
+// keyword consumes a keyword, if it is next in the text
+func (p *exprParser) keyword(word string) bool {
+	p.space()
+	if !strings.HasPrefix(p.text, word) {
+		return false
+	}
+	if rest := p.text[len(word):]; rest != "" && strings.IndexByte(" \t\r\n(", rest[0]) < 0 {
+		return false
+	}
+	p.text = p.text[len(word):]
+	return true
+}
+
+// next consumes the given character, if it is next in the text
+func (p *exprParser) next(c byte) bool {
+	p.space()
+	if p.text == "" || p.text[0] != c {
+		return false
+	}
+	p.text = p.text[1:]
+	return true
+}
+
+func (p *exprParser) space() {
+	p.text = strings.TrimLeft(p.text, " \t\r\n")
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isNameChar returns true if c may appear in a function name
+func isNameChar(c byte) bool {
+	return isDigit(c) || c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+var (
+	trueValue  = reflect.ValueOf(true)
+	falseValue = reflect.ValueOf(false)
+)
+
+// eval evaluates an expression
+func (eval *evaluator) eval(e expr) reflect.Value {
+	switch e := e.(type) {
+	case nil:
+		return reflect.Value{}
+	case *path:
+		return eval.get(e)
+	case *literalExpr:
+		return e.val
+	case *notExpr:
+		return boolValue(!isTruthy(eval.eval(e.x)))
+	case *callExpr:
+		return eval.call(e)
+	case *binaryExpr:
+		switch e.op {
+		case "and":
+			return boolValue(isTruthy(eval.eval(e.x)) && isTruthy(eval.eval(e.y)))
+		case "or":
+			return boolValue(isTruthy(eval.eval(e.x)) || isTruthy(eval.eval(e.y)))
+		default:
+			return boolValue(compare(e.op, eval.eval(e.x), eval.eval(e.y)))
+		}
+	default:
+		panic("Invalid expression")
+	}
+}
+
+func boolValue(b bool) reflect.Value {
+	if b {
+		return trueValue
+	}
+	return falseValue
+}
+
+// Truthy returns true if a value is truthy, as used by conditions. Pointers are followed, and nil pointers are falsey.
+func Truthy(v interface{}) bool {
+	return isTruthy(unwrap(reflect.ValueOf(v)))
+}
+
+// Equal returns true if two values are equal.
+// Values of the types defined by the HTMPL specification are equal if they have the same type and contents, with all numbers being of the same type.
+// Other values are equal if they have the same comparable type and are equal according to Go.
+func Equal(a, b interface{}) bool {
+	return equal(reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+// Compare applies a comparison operator (==, !=, <, <=, > or >=) to two values.
+// Only two numbers or two strings are ordered; other ordering comparisons are false.
+func Compare(op string, a, b interface{}) bool {
+	return compare(op, reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+// CompareKeys compares two map keys by their natural order, returning -1, 0 or +1, as used by sorted <for> elements.
+// Numbers are ordered numerically, strings lexicographically, and false before true.
+// Keys of different kinds are ordered empties, bools, numbers, strings, then anything else, which is ordered by its string form.
+func CompareKeys(a, b interface{}) int {
+	return compareKeys(unwrap(reflect.ValueOf(a)), unwrap(reflect.ValueOf(b)))
+}
+
+func compare(op string, a, b reflect.Value) bool {
+	switch op {
+	case "==":
+		return equal(a, b)
+	case "!=":
+		return !equal(a, b)
+	}
+
+	a, b = unwrap(a), unwrap(b)
+	var c int
+	switch {
+	case a.Kind() == reflect.String && b.Kind() == reflect.String:
+		c = strings.Compare(a.String(), b.String())
+	case isNumber(a) && isNumber(b):
+		var ok bool
+		if c, ok = compareNumber(a, b); !ok {
+			return false
+		}
+	default:
+		return false
+	}
+
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	default:
+		panic("Invalid operator " + op)
+	}
+}
+
+func equal(a, b reflect.Value) bool {
+	a, b = unwrap(a), unwrap(b)
+	switch {
+	case !a.IsValid() || !b.IsValid():
+		return a.IsValid() == b.IsValid()
+
+	case a.Kind() == reflect.Bool && b.Kind() == reflect.Bool:
+		return a.Bool() == b.Bool()
+
+	case isNumber(a) && isNumber(b):
+		c, ok := compareNumber(a, b)
+		return ok && c == 0
+
+	case a.Kind() == reflect.String && b.Kind() == reflect.String:
+		return a.String() == b.String()
+
+	case (a.Kind() == reflect.Array || a.Kind() == reflect.Slice) && (b.Kind() == reflect.Array || b.Kind() == reflect.Slice):
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !equal(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+
+	case a.Kind() == reflect.Map && b.Kind() == reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		if a.Type().Key() != b.Type().Key() {
+			// Only compare maps with keys of different types if they are both empty
+			return a.Len() == 0
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			v := b.MapIndex(iter.Key())
+			if !v.IsValid() || !equal(iter.Value(), v) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		return a.Type() == b.Type() && a.Comparable() && a.Equal(b)
+	}
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// compareNumber compares two numbers of any kind, without loss of precision for integers.
+// The numbers are unordered if either is NaN.
+func compareNumber(a, b reflect.Value) (int, bool) {
+	switch {
+	case a.CanInt() && b.CanInt():
+		return cmp.Compare(a.Int(), b.Int()), true
+	case a.CanUint() && b.CanUint():
+		return cmp.Compare(a.Uint(), b.Uint()), true
+	case a.CanInt() && b.CanUint():
+		if a.Int() < 0 {
+			return -1, true
+		}
+		return cmp.Compare(uint64(a.Int()), b.Uint()), true
+	case a.CanUint() && b.CanInt():
+		if b.Int() < 0 {
+			return 1, true
+		}
+		return cmp.Compare(a.Uint(), uint64(b.Int())), true
+	}
+	x, y := toFloat(a), toFloat(b)
+	if x != x || y != y {
+		return 0, false
+	}
+	return cmp.Compare(x, y), true
+}
+
+func compareKeys(a, b reflect.Value) int {
+	ka, kb := keyKind(a), keyKind(b)
+	if ka != kb {
+		return cmp.Compare(ka, kb)
+	}
+	switch ka {
+	case 0:
+		return 0
+	case 1:
+		if a.Bool() == b.Bool() {
+			return 0
+		} else if b.Bool() {
+			return -1
+		}
+		return 1
+	case 2:
+		if c, ok := compareNumber(a, b); ok {
+			return c
+		}
+		// NaN is ordered before all other numbers
+		return cmp.Compare(toFloat(a), toFloat(b))
+	case 3:
+		return strings.Compare(a.String(), b.String())
+	default:
+		return strings.Compare(stringify(a), stringify(b))
+	}
+}
+
+// keyKind returns the position of a key's kind in the order used by compareKeys
+func keyKind(v reflect.Value) int {
+	switch {
+	case !v.IsValid():
+		return 0
+	case v.Kind() == reflect.Bool:
+		return 1
+	case isNumber(v):
+		return 2
+	case v.Kind() == reflect.String:
+		return 3
+	}
+	return 4
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case v.CanInt():
+		return float64(v.Int())
+	case v.CanUint():
+		return float64(v.Uint())
+	default:
+		return v.Float()
+	}
+}
@@ -0,0 +1,82 @@
+package htmpl
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A FuncMap maps names to functions that can be called from templates using the pipe syntax, such as `.Created | date "2006-01-02"`.
+// The value before the pipe is passed as the first argument, followed by any other arguments.
+//
+// Each function must return either a single value, or a value and an error.
+// If a non-nil error is returned, evaluation of the expression results in an empty and the error is reported.
+type FuncMap map[string]interface{}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// function returns the function with the given name
+func (c *Config) function(name string) (reflect.Value, error) {
+	f, ok := c.Funcs[name]
+	if !ok {
+		f, ok = builtinFuncs[name]
+	}
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("undefined function %q", name)
+	}
+	fn := reflect.ValueOf(f)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return reflect.Value{}, fmt.Errorf("%q is not a function", name)
+	}
+	t := fn.Type()
+	if t.NumOut() < 1 || t.NumOut() > 2 || t.NumOut() == 2 && t.Out(1) != errorType {
+		return reflect.Value{}, fmt.Errorf("function %q must return one value, or a value and an error", name)
+	}
+	return fn, nil
+}
+
+// call calls a function, converting its arguments to the required types
+func (eval *evaluator) call(e *callExpr) reflect.Value {
+	t := e.fn.Type()
+	args := make([]reflect.Value, len(e.args))
+	for i, arg := range e.args {
+		var paramType reflect.Type
+		if t.IsVariadic() && i >= t.NumIn()-1 {
+			paramType = t.In(t.NumIn() - 1).Elem()
+		} else {
+			paramType = t.In(i)
+		}
+		v, err := convertArg(eval.eval(arg), paramType)
+		if err != nil {
+			eval.fail(e.source, fmt.Errorf("argument %d to %q: %w", i+1, e.name, err))
+			return reflect.Value{}
+		}
+		args[i] = v
+	}
+
+	out := e.fn.Call(args)
+	if len(out) == 2 && !out[1].IsNil() {
+		eval.fail(e.source, fmt.Errorf("calling %q: %w", e.name, out[1].Interface().(error)))
+		return reflect.Value{}
+	}
+	return unwrap(out[0])
+}
+
+// convertArg converts a value for use as an argument of type t.
+// Empty values are converted to the zero value of the type, and numbers may be converted to other numeric types if they are representable.
+func convertArg(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	switch {
+	case !v.IsValid():
+		return reflect.Zero(t), nil
+	case v.Type().AssignableTo(t):
+		return v, nil
+	case v.CanAddr() && v.Addr().Type().AssignableTo(t):
+		// The value was unwrapped from a pointer
+		return v.Addr(), nil
+	case isNumber(v) && isNumber(reflect.Zero(t)) || v.Kind() == reflect.String && t.Kind() == reflect.String:
+		if c := v.Convert(t); equal(c, v) {
+			return c, nil
+		}
+		return reflect.Value{}, fmt.Errorf("%v cannot be represented by %s", v, t)
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %s as %s", v.Type(), t)
+}
@@ -0,0 +1,218 @@
+package gen
+
+import (
+	"fmt"
+	"go/types"
+	"strings"
+)
+
+// A builtinFunc generates a call to a built-in function, given its name and arguments.
+// The piped value is the first argument.
+type builtinFunc func(gen *generator, name string, args []operand) (operand, error)
+
+var (
+	stringType  = types.Typ[types.String]
+	intType     = types.Typ[types.Int]
+	float64Type = types.Typ[types.Float64]
+	anyType     = types.Universe.Lookup("any").Type()
+	errType     = types.Universe.Lookup("error").Type()
+)
+
+// builtinFuncs are the functions available to all templates, unless replaced by functions in Config.Funcs.
+// They call the helpers in runtime.go, matching the built-in functions of the evaluator.
+var builtinFuncs = map[string]builtinFunc{
+	"upper":     fixed("gen.Upper", false, []types.Type{stringType}, stringType),
+	"lower":     fixed("gen.Lower", false, []types.Type{stringType}, stringType),
+	"title":     fixed("gen.Title", false, []types.Type{stringType}, stringType),
+	"trim":      fixed("gen.Trim", false, []types.Type{stringType}, stringType),
+	"truncate":  fixed("gen.Truncate", false, []types.Type{stringType, intType}, stringType),
+	"json":      fixed("gen.JSON", false, []types.Type{anyType}, stringType, errType),
+	"pluralize": fixed("gen.Pluralize", false, []types.Type{float64Type, stringType, stringType}, stringType),
+	"printf":    fixed("gen.Printf", true, []types.Type{anyType, stringType, types.NewSlice(anyType)}, stringType),
+	"join":      genJoin,
+	"default":   genDefault,
+	"len":       genLen,
+	"first":     genElement,
+	"last":      genElement,
+	"slice":     genSlice,
+	"urlquery":  genURLQuery,
+}
+
+// fixed returns a builtinFunc calling a helper with the given signature
+func fixed(code string, variadic bool, params []types.Type, results ...types.Type) builtinFunc {
+	tuple := func(tys []types.Type) *types.Tuple {
+		vars := make([]*types.Var, len(tys))
+		for i, ty := range tys {
+			vars[i] = types.NewParam(0, nil, "", ty)
+		}
+		return types.NewTuple(vars...)
+	}
+	sig := types.NewSignatureType(nil, nil, nil, tuple(params), tuple(results), variadic)
+	return func(gen *generator, name string, args []operand) (operand, error) {
+		return gen.call(name, function{code, sig}, args)
+	}
+}
+
+// arity returns an error if the number of arguments is outside the range [min, max]
+func arity(name string, args []operand, min, max int) error {
+	switch {
+	case len(args) < min && min == max:
+		return fmt.Errorf("wrong number of arguments to %q: expected %d, received %d", name, min, len(args))
+	case len(args) < min:
+		return fmt.Errorf("wrong number of arguments to %q: expected at least %d, received %d", name, min, len(args))
+	case len(args) > max && max >= 0:
+		return fmt.Errorf("wrong number of arguments to %q: expected %d, received %d", name, max, len(args))
+	}
+	return nil
+}
+
+func genJoin(gen *generator, name string, args []operand) (operand, error) {
+	if err := arity(name, args, 2, 2); err != nil {
+		return operand{}, err
+	}
+	sep, err := gen.arg(args[1], stringType)
+	if err != nil {
+		return operand{}, fmt.Errorf("argument 2 to %q: %w", name, err)
+	}
+	switch ty := args[0].ty.(type) {
+	case nil:
+		return operand{code: `""`, ty: stringType}, nil
+	case *types.Array:
+		return operand{code: fmt.Sprintf("gen.Join(%s, %s)", gen.sliceArray(args[0].code, ty), sep), ty: stringType}, nil
+	case *types.Slice:
+		return operand{code: fmt.Sprintf("gen.Join(%s, %s)", args[0].code, sep), ty: stringType}, nil
+	default:
+		return operand{}, fmt.Errorf("cannot join %s", ty)
+	}
+}
+
+func genDefault(gen *generator, name string, args []operand) (operand, error) {
+	if err := arity(name, args, 2, 2); err != nil {
+		return operand{}, err
+	}
+	v, def := args[0], args[1]
+	switch {
+	case v.ty == nil:
+		return def, nil
+	case def.ty == nil:
+		return v, nil
+	}
+	// The default replaces the value, so must be assignable to its type.
+	// Both are converted, as the value may have a named type with the same underlying type.
+	if !assignable(def, v.ty) {
+		return operand{}, fmt.Errorf("argument 2 to %q: cannot use %s as %s", name, def.ty, gen.typeString(v.ty))
+	}
+	typ := gen.typeString(v.ty)
+	return operand{code: fmt.Sprintf("gen.Default((%s)(%s), (%s)(%s))", typ, v.code, typ, def.code), ty: v.ty}, nil
+}
+
+// assignable returns true if an operand can be assigned to a variable of type t.
+// As with untyped constants in Go, literals can be assigned to basic types of the same kind,
+// and integer literals can be assigned to any numeric type that can represent them.
+func assignable(x operand, t types.Type) bool {
+	if types.AssignableTo(x.ty, t) {
+		return true
+	}
+	xt, xok := x.ty.(*types.Basic)
+	tt, tok := t.Underlying().(*types.Basic)
+	if !x.constant || !xok || !tok {
+		return false
+	}
+	xi, ti := xt.Info(), tt.Info()
+	switch {
+	case xi&types.IsString != 0:
+		return ti&types.IsString != 0
+	case xi&types.IsInteger != 0:
+		return ti&types.IsFloat != 0 || ti&types.IsInteger != 0 && (ti&types.IsUnsigned == 0 || !strings.HasPrefix(x.code, "-"))
+	case xi&types.IsFloat != 0:
+		return ti&types.IsFloat != 0
+	}
+	return false
+}
+
+func genLen(gen *generator, name string, args []operand) (operand, error) {
+	if err := arity(name, args, 1, 1); err != nil {
+		return operand{}, err
+	}
+	switch ty := args[0].ty.(type) {
+	case nil:
+		return operand{code: "0", ty: intType}, nil
+	case *types.Array, *types.Slice, *types.Map, *types.Chan:
+		return operand{code: fmt.Sprintf("len(%s)", args[0].code), ty: intType}, nil
+	case *types.Basic:
+		if ty.Info()&types.IsString != 0 {
+			return operand{code: fmt.Sprintf("gen.Len(%s)", args[0].code), ty: intType}, nil
+		}
+	}
+	return operand{}, fmt.Errorf("cannot take length of %s", args[0].ty)
+}
+
+// genElement generates calls to first and last
+func genElement(gen *generator, name string, args []operand) (operand, error) {
+	if err := arity(name, args, 1, 1); err != nil {
+		return operand{}, err
+	}
+	switch ty := args[0].ty.(type) {
+	case nil:
+		return operand{}, nil
+	case *types.Slice:
+		helper := "gen.First"
+		if name == "last" {
+			helper = "gen.Last"
+		}
+		return gen.unwrapOperand(fmt.Sprintf("%s(%s)", helper, args[0].code), ty.Elem()), nil
+	case *types.Array:
+		if ty.Len() == 0 {
+			return operand{}, nil
+		}
+		i := int64(0)
+		if name == "last" {
+			i = ty.Len() - 1
+		}
+		return gen.unwrapOperand(fmt.Sprintf("%s[%d]", args[0].code, i), ty.Elem()), nil
+	default:
+		return operand{}, fmt.Errorf("cannot take element of %s", ty)
+	}
+}
+
+func genSlice(gen *generator, name string, args []operand) (operand, error) {
+	// slice is variadic, so its arguments are only limited when called
+	if err := arity(name, args, 2, -1); err != nil {
+		return operand{}, err
+	} else if len(args) > 3 {
+		return operand{}, fmt.Errorf("calling %q: too many indices: expected at most 2, received %d", name, len(args)-1)
+	}
+	indices := ""
+	for i, arg := range args[1:] {
+		code, err := gen.arg(arg, intType)
+		if err != nil {
+			return operand{}, fmt.Errorf("argument %d to %q: %w", i+2, name, err)
+		}
+		indices += ", " + code
+	}
+	switch ty := args[0].ty.(type) {
+	case nil:
+		return operand{}, nil
+	case *types.Array:
+		return operand{code: fmt.Sprintf("gen.Slice(%s%s)", gen.sliceArray(args[0].code, ty), indices), ty: types.NewSlice(ty.Elem())}, nil
+	case *types.Slice:
+		return operand{code: fmt.Sprintf("gen.Slice(%s%s)", args[0].code, indices), ty: ty}, nil
+	case *types.Basic:
+		if ty.Info()&types.IsString != 0 {
+			return operand{code: fmt.Sprintf("gen.Substr(%s%s)", args[0].code, indices), ty: stringType}, nil
+		}
+	}
+	return operand{}, fmt.Errorf("cannot slice %s", args[0].ty)
+}
+
+// sliceArray returns an expression slicing a copy of an array, which may not be addressable
+func (gen *generator) sliceArray(code string, ty *types.Array) string {
+	return fmt.Sprintf("func(a %s) %s {\nreturn a[:]\n}(%s)", gen.typeString(ty), gen.typeString(types.NewSlice(ty.Elem())), code)
+}
+
+func genURLQuery(gen *generator, name string, args []operand) (operand, error) {
+	if err := arity(name, args, 1, 1); err != nil {
+		return operand{}, err
+	}
+	return operand{code: fmt.Sprintf("gen.URLQuery(%s)", stringify(args[0].code, args[0].ty)), ty: stringType}, nil
+}
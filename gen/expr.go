@@ -0,0 +1,356 @@
+package gen
+
+import (
+	"fmt"
+	"go/types"
+	"strconv"
+	"strings"
+)
+
+// expr generates a Go expression for an expression in a template.
+// If the expression is invalid or refers to undefined values, the returned type is nil.
+func (gen *generator) expr(src string) (string, types.Type) {
+	x := gen.operand(src)
+	return x.code, x.ty
+}
+
+// operand is like expr, but returns an operand, which also records whether the expression is a literal
+func (gen *generator) operand(src string) operand {
+	p := &exprParser{gen: gen, text: src}
+	x := p.pipe()
+	p.space()
+	if p.err || p.text != "" {
+		return operand{}
+	}
+	return x
+}
+
+// An operand is a generated Go expression and its type.
+// Constant operands are literals. Number literals may be compared with numbers of any type.
+type operand struct {
+	code     string
+	ty       types.Type
+	constant bool
+	addr     string // The code for the pointer the value was unwrapped from, if any
+}
+
+var boolType = types.Typ[types.Bool]
+
+// exprParser parses expressions, using the same grammar as the evaluator
+type exprParser struct {
+	gen  *generator
+	text string
+	err  bool
+}
+
+func (p *exprParser) pipe() operand {
+	x := p.or()
+	for !p.err && p.next('|') {
+		p.space()
+		end := 0
+		for end < len(p.text) && isNameChar(p.text[end]) {
+			end++
+		}
+		name := p.text[:end]
+		p.text = p.text[end:]
+		args := []operand{x}
+		for {
+			p.space()
+			if p.text == "" || p.text[0] == '|' || p.text[0] == ')' {
+				break
+			}
+			args = append(args, p.operand())
+		}
+
+		var err error
+		if fn, ok := p.gen.funcs[name]; ok {
+			x, err = p.gen.call(name, fn, args)
+		} else if fn, ok := builtinFuncs[name]; ok {
+			x, err = fn(p.gen, name, args)
+		} else {
+			err = fmt.Errorf("undefined function %q", name)
+		}
+		if err != nil {
+			p.gen.fail(err)
+			p.err = true
+			return operand{}
+		}
+	}
+	return x
+}
+
+func (p *exprParser) or() operand {
+	x := p.and()
+	for !p.err && p.keyword("or") {
+		y := p.and()
+		x = operand{code: fmt.Sprintf("(%s || %s)", truthy(x.code, x.ty), truthy(y.code, y.ty)), ty: boolType}
+	}
+	return x
+}
+
+func (p *exprParser) and() operand {
+	x := p.not()
+	for !p.err && p.keyword("and") {
+		y := p.not()
+		x = operand{code: fmt.Sprintf("(%s && %s)", truthy(x.code, x.ty), truthy(y.code, y.ty)), ty: boolType}
+	}
+	return x
+}
+
+func (p *exprParser) not() operand {
+	if p.keyword("not") {
+		x := p.not()
+		return operand{code: fmt.Sprintf("!(%s)", truthy(x.code, x.ty)), ty: boolType}
+	}
+	return p.cmp()
+}
+
+func (p *exprParser) cmp() operand {
+	x := p.operand()
+	p.space()
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(p.text, op) {
+			p.text = p.text[len(op):]
+			y := p.operand()
+			return operand{code: compare(op, x, y), ty: boolType}
+		}
+	}
+	return x
+}
+
+func (p *exprParser) operand() operand {
+	p.space()
+	if p.text == "" {
+		p.err = true
+		return operand{}
+	}
+	switch c := p.text[0]; {
+	case c == '(':
+		p.text = p.text[1:]
+		x := p.pipe()
+		p.space()
+		if !strings.HasPrefix(p.text, ")") {
+			p.err = true
+			return operand{}
+		}
+		p.text = p.text[1:]
+		return x
+
+	case c == '"' || c == '\'':
+		return p.string()
+
+	case isDigit(c) || c == '-' && len(p.text) > 1 && isDigit(p.text[1]):
+		return p.number()
+
+	case strings.IndexByte(")=!<>|", c) >= 0:
+		p.err = true
+		return operand{}
+
+	default:
+		end := strings.IndexAny(p.text, " \t\r\n()=!<>\"'|")
+		if end < 0 {
+			end = len(p.text)
+		}
+		x := p.gen.path(p.text[:end])
+		p.text = p.text[end:]
+		return x
+	}
+}
+
+func (p *exprParser) string() operand {
+	quote := p.text[0]
+	b := strings.Builder{}
+	for i := 1; i < len(p.text); i++ {
+		switch c := p.text[i]; {
+		case c == '\\' && i+1 < len(p.text):
+			i++
+			b.WriteByte(p.text[i])
+		case c == quote:
+			p.text = p.text[i+1:]
+			return operand{code: strconv.Quote(b.String()), ty: types.Typ[types.String], constant: true}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	p.err = true
+	return operand{}
+}
+
+func (p *exprParser) number() operand {
+	end := 1
+	for end < len(p.text) && strings.IndexByte(" \t\r\n()=!<>|", p.text[end]) < 0 {
+		end++
+	}
+	text := p.text[:end]
+	p.text = p.text[end:]
+	if n, err := strconv.Atoi(text); err == nil {
+		return operand{code: strconv.Itoa(n), ty: types.Typ[types.Int], constant: true}
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil && !strings.ContainsAny(text, "xXpP_") {
+		code := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(code, ".e") {
+			// Ensure the constant is not an integer
+			code += ".0"
+		}
+		return operand{code: code, ty: types.Typ[types.Float64], constant: true}
+	}
+	p.err = true
+	return operand{}
+}
+
+func (p *exprParser) keyword(word string) bool {
+	p.space()
+	if !strings.HasPrefix(p.text, word) {
+		return false
+	}
+	if rest := p.text[len(word):]; rest != "" && strings.IndexByte(" \t\r\n(", rest[0]) < 0 {
+		return false
+	}
+	p.text = p.text[len(word):]
+	return true
+}
+
+// next consumes the given character, if it is next in the text
+func (p *exprParser) next(c byte) bool {
+	p.space()
+	if p.text == "" || p.text[0] != c {
+		return false
+	}
+	p.text = p.text[1:]
+	return true
+}
+
+func (p *exprParser) space() {
+	p.text = strings.TrimLeft(p.text, " \t\r\n")
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isNameChar returns true if c may appear in a function name
+func isNameChar(c byte) bool {
+	return isDigit(c) || c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// call generates a call to a function, converting the arguments to the types of its parameters
+func (gen *generator) call(name string, fn function, args []operand) (operand, error) {
+	params := fn.sig.Params()
+	if n := len(args); fn.sig.Variadic() && n < params.Len()-1 {
+		return operand{}, fmt.Errorf("wrong number of arguments to %q: expected at least %d, received %d", name, params.Len()-1, n)
+	} else if !fn.sig.Variadic() && n != params.Len() {
+		return operand{}, fmt.Errorf("wrong number of arguments to %q: expected %d, received %d", name, params.Len(), n)
+	}
+
+	codes := make([]string, len(args))
+	for i, arg := range args {
+		var t types.Type
+		if fn.sig.Variadic() && i >= params.Len()-1 {
+			t = params.At(params.Len() - 1).Type().(*types.Slice).Elem()
+		} else {
+			t = params.At(i).Type()
+		}
+		code, err := gen.arg(arg, t)
+		if err != nil {
+			return operand{}, fmt.Errorf("argument %d to %q: %w", i+1, name, err)
+		}
+		codes[i] = code
+	}
+
+	code := fmt.Sprintf("%s(%s)", fn.code, strings.Join(codes, ", "))
+	if fn.sig.Results().Len() == 2 {
+		code = fmt.Sprintf("gen.Result(%s)", code)
+	}
+	return gen.unwrapOperand(code, fn.sig.Results().At(0).Type()), nil
+}
+
+// arg generates an argument of type t
+func (gen *generator) arg(x operand, t types.Type) (string, error) {
+	if x.ty == nil {
+		return fmt.Sprintf("*new(%s)", gen.typeString(t)), nil
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Interface:
+		return x.code, nil
+
+	case *types.Basic:
+		// Convert between basic types of the same kind, as they may have different names
+		if xt, ok := x.ty.(*types.Basic); ok {
+			for _, kind := range []types.BasicInfo{types.IsBoolean, types.IsString, types.IsInteger | types.IsFloat} {
+				if xt.Info()&kind != 0 && u.Info()&kind != 0 {
+					return fmt.Sprintf("%s(%s)", gen.typeString(t), x.code), nil
+				}
+			}
+		}
+
+	case *types.Pointer:
+		// Pointers are unwrapped by paths and calls, so pass the pointer instead
+		if x.addr != "" && types.AssignableTo(x.ty, u.Elem()) {
+			return x.addr, nil
+		}
+	}
+	if types.AssignableTo(x.ty, t) {
+		return x.code, nil
+	}
+	return "", fmt.Errorf("cannot use %s as %s", x.ty, gen.typeString(t))
+}
+
+// compare generates a comparison of two operands, with the same results as htmpl.Compare
+func compare(op string, x, y operand) string {
+	xt, xok := x.ty.(*types.Basic)
+	yt, yok := y.ty.(*types.Basic)
+	if !xok || !yok {
+		return fmt.Sprintf("htmpl.Compare(%q, %s, %s)", op, valueOrNil(x), valueOrNil(y))
+	}
+
+	const number = types.IsInteger | types.IsFloat
+	xi, yi := xt.Info(), yt.Info()
+	switch {
+	case xi&types.IsBoolean != 0 && yi&types.IsBoolean != 0:
+		if op == "==" || op == "!=" {
+			return fmt.Sprintf("bool(%s) %s bool(%s)", x.code, op, y.code)
+		}
+		return "false"
+
+	case xi&types.IsString != 0 && yi&types.IsString != 0:
+		return fmt.Sprintf("string(%s) %s string(%s)", x.code, op, y.code)
+
+	case xi&number != 0 && yi&number != 0:
+		// Convert both numbers to a type that can represent them, as the evaluator does
+		var conv string
+		switch {
+		case xi&types.IsFloat != 0 || yi&types.IsFloat != 0:
+			conv = "float64"
+		case xi&types.IsUnsigned == yi&types.IsUnsigned:
+			conv = "int64"
+			if xi&types.IsUnsigned != 0 {
+				conv = "uint64"
+			}
+		case x.constant && !strings.HasPrefix(x.code, "-") || y.constant && !strings.HasPrefix(y.code, "-"):
+			conv = "uint64"
+		default:
+			return fmt.Sprintf("htmpl.Compare(%q, %s, %s)", op, x.code, y.code)
+		}
+		return fmt.Sprintf("%s %s %s", convert(conv, x), op, convert(conv, y))
+
+	default:
+		// Values of different types are never equal, and are unordered
+		return strconv.FormatBool(op == "!=")
+	}
+}
+
+// convert converts a numeric operand to the named type, unless it is an untyped constant
+func convert(conv string, x operand) string {
+	if x.constant {
+		return x.code
+	}
+	return fmt.Sprintf("%s(%s)", conv, x.code)
+}
+
+// valueOrNil returns the code for an operand, or nil if the operand is undefined
+func valueOrNil(x operand) string {
+	if x.ty == nil {
+		return "nil"
+	}
+	return x.code
+}
@@ -4,12 +4,21 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"go/token"
 	"go/types"
+	"io/fs"
 	"io/ioutil"
+	"math"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/vktec/htmlparse"
+	"github.com/vktec/htmpl"
+	"github.com/vktec/htmpl/internal/htmlcontext"
+	"github.com/vktec/htmpl/internal/htmlpos"
 	"golang.org/x/net/html"
 	"golang.org/x/tools/go/packages"
 	"golang.org/x/tools/imports"
@@ -18,7 +27,58 @@ import (
 var ErrMultiplePackages = errors.New("Multiple packages found")
 var ErrCompile = errors.New("Compile errors")
 
+// A Config specifies options for code generation
+type Config struct {
+	// FS is used to load templates referenced by <include> elements.
+	// If nil, templates cannot include other templates.
+	FS fs.FS
+
+	// Funcs maps the names of functions that may be called from templates to Go expressions for those functions,
+	// such as "strings.ToUpper" or "formatDate". The expressions are resolved in the package the code is generated in,
+	// and the generated code calls them directly.
+	Funcs map[string]string
+
+	// SortMaps causes all <for> elements to iterate over maps in the natural order of their keys, as if they had the sort attribute.
+	SortMaps bool
+
+	// StructTags causes struct fields to be named by their htmpl or json struct tags, as with htmpl.Config.StructTags.
+	StructTags bool
+
+	// Policy is a Go expression for the *htmpl.Policy that sanitizes HTML parsed from strings by <v noescape> elements,
+	// as with htmpl.Config.Policy. It is evaluated for each substitution, so should usually be a package-level variable.
+	//
+	// Policy is empty by default, and if it is empty, the HTML is NOT sanitized, as with a nil htmpl.Config.Policy.
+	Policy string
+}
+
+// Generate generates Go code for a template, using the default configuration
 func Generate(outPath, funcname, dotTyName string, node *html.Node) error {
+	return (&Config{}).Generate(outPath, funcname, dotTyName, node)
+}
+
+// GenerateFile is like Generate, but loads and parses the template with the given name from c.FS.
+// Problems found in the template are reported as *htmpl.Error values giving their positions in it.
+func (c *Config) GenerateFile(outPath, funcname, dotTyName, name string) error {
+	return c.generate(outPath, funcname, dotTyName, nil, name)
+}
+
+// Generate generates a Go function named funcname, which evaluates a template with a dot of type dotTyName.
+// The function is written to a new file at outPath, which must be in the package in the current directory.
+//
+// The generated code is statically typed, so it differs from htmpl.Evaluate in some cases:
+// values that would be empty, such as missing map keys or out of range indices, are the zero value of their type instead,
+// structs can only be indexed with bracketed paths if all of their fields have the same type,
+// values implementing htmpl.Lookuper cannot be indexed,
+// values of trusted types such as htmpl.HTML are only recognised when they are substituted directly from variable paths,
+// and values of interface types cannot be indexed or iterated over, as the types of their contents are not known.
+//
+// Problems found in the template are reported as *htmpl.Error values.
+func (c *Config) Generate(outPath, funcname, dotTyName string, node *html.Node) error {
+	return c.generate(outPath, funcname, dotTyName, node, "")
+}
+
+// generate generates code for a template, which is the given node, or is loaded from c.FS if name is not empty
+func (c *Config) generate(outPath, funcname, dotTyName string, node *html.Node, name string) error {
 	pkgs, err := packages.Load(&packages.Config{Mode: packages.NeedName}, ".")
 	if err != nil {
 		return err
@@ -31,6 +91,19 @@ func Generate(outPath, funcname, dotTyName string, node *html.Node) error {
 	fmt.Fprintf(&stub, "package %s\n", pkgs[0].Name)
 	stub.WriteString(`import "golang.org/x/net/html"`)
 	fmt.Fprintf(&stub, "\nfunc %s(dot %s) (out []*html.Node) {return}\n", funcname, dotTyName)
+	// Declare a variable for each function, so its type can be found
+	funcNames := make([]string, 0, len(c.Funcs))
+	for name := range c.Funcs {
+		funcNames = append(funcNames, name)
+	}
+	sort.Strings(funcNames)
+	for i, name := range funcNames {
+		fmt.Fprintf(&stub, "var htmplFunc%d = %s\n", i, c.Funcs[name])
+	}
+	if c.Policy != "" {
+		// Check the type of the policy
+		fmt.Fprintf(&stub, "var htmplPolicy *htmpl.Policy = %s\n", c.Policy)
+	}
 	istub, err := imports.Process(outPath, stub.Bytes(), nil)
 	if err != nil {
 		return err
@@ -64,23 +137,47 @@ func Generate(outPath, funcname, dotTyName string, node *html.Node) error {
 	if !ok {
 		panic("Stub function is not a function")
 	}
-	dotTy := funcTy.Params().At(0).Type().Underlying()
+	dotTy := funcTy.Params().At(0).Type()
 
-	gen := &generator{types: map[string][]types.Type{
-		".": []types.Type{dotTy},
-	}}
+	gen := newGenerator(c, pkgs[0].Types, dotTy)
+	gen.funcs = make(map[string]function, len(funcNames))
+	for i, name := range funcNames {
+		sig, ok := scope.Lookup(fmt.Sprintf("htmplFunc%d", i)).Type().(*types.Signature)
+		if !ok {
+			return fmt.Errorf("%q is not a function", name)
+		}
+		n := sig.Results().Len()
+		if n < 1 || n > 2 || n == 2 && !types.Identical(sig.Results().At(1).Type(), types.Universe.Lookup("error").Type()) {
+			return fmt.Errorf("function %q must return one value, or a value and an error", name)
+		}
+		gen.funcs[name] = function{c.Funcs[name], sig}
+	}
 	gen.Printf("package %s\n", pkgs[0].Name)
 	gen.WriteString(`import (
 	"fmt"
 
+	"github.com/vktec/htmpl"
 	"github.com/vktec/htmpl/gen"
 	"golang.org/x/net/html"
 )
 `)
+	if name != "" {
+		if node, err = gen.load(name); err != nil {
+			return err
+		}
+		gen.stack = append(gen.stack, name)
+	}
 	gen.Printf("func %s(dot %s) (out []*html.Node) {\n", funcname, dotTyName)
+	gen.WriteString("dollar := dot\n_ = dollar\n")
+	if err := gen.define(node, map[*html.Node]bool{}); err != nil {
+		return err
+	}
 	if err := gen.genCode(node); err != nil {
 		return err
 	}
+	if gen.err != nil {
+		return gen.err
+	}
 	gen.WriteString("return\n}\n")
 	code, err := imports.Process(outPath, gen.Bytes(), nil)
 	if err != nil {
@@ -90,16 +187,102 @@ func Generate(outPath, funcname, dotTyName string, node *html.Node) error {
 	return ioutil.WriteFile(outPath, code, 0666)
 }
 
+// newGenerator returns a generator for code in pkg, evaluating a template with a dot of type dotTy
+func newGenerator(c *Config, pkg *types.Package, dotTy types.Type) *generator {
+	dotTy = types.Unalias(dotTy)
+	gen := &generator{config: c, pkg: pkg, types: map[string][]types.Type{
+		".": []types.Type{dotTy},
+		"$": []types.Type{dotTy},
+	}}
+	gen.qualifier = func(p *types.Package) string {
+		if p == pkg {
+			return ""
+		}
+		return p.Name()
+	}
+	return gen
+}
+
 type generator struct {
 	bytes.Buffer
-	types map[string][]types.Type
+	config    *Config
+	pkg       *types.Package // The package the code is generated in
+	types     map[string][]types.Type
+	funcs     map[string]function
+	qualifier types.Qualifier // Qualifies type names for use in the generated code
+	err       error           // The first problem found in an expression
+	node      *html.Node      // The innermost element being generated, in which problems are reported
+
+	pos   map[*html.Node]htmlpos.Position // The positions of the nodes of templates loaded from files
+	names map[*html.Node]string           // The names of templates loaded from files, keyed by their root nodes
+
+	partials  map[string]*html.Node // Templates loaded by <include> and <extends> elements
+	stack     []string              // The names of the included templates currently being generated
+	overrides map[string]*override  // Blocks overridden by templates extending the one being generated
+
+	components  map[string]*html.Node // The <define> element of each component
+	calls       []componentCall       // The functions of the components currently being generated
+	slots       []map[string]string   // The functions generating the slot content of each component being generated
+	nslots      int
+	ncomponents int
+}
+
+// A componentCall is a function generated for a use of a component
+type componentCall struct {
+	key string // Identifies the component, the types of the variables in scope and the filled slots
+	fn  string
+}
+
+// An override replaces the content of a block in a layout
+type override struct {
+	node *html.Node // The <block> element containing the new content
+	used bool
+}
+
+// A function is a Go function callable from templates
+type function struct {
+	code string // The Go expression for the function
+	sig  *types.Signature
 }
 
 func (gen *generator) Printf(format string, args ...interface{}) {
 	fmt.Fprintf(gen, format, args...)
 }
 
-func (gen *generator) genCode(node *html.Node) error {
+// fail records a problem with an expression. Only the first problem is kept.
+func (gen *generator) fail(err error) {
+	if gen.err == nil {
+		gen.err = gen.error(gen.node, err)
+	}
+}
+
+// error describes a problem found in a node, giving its position if its template was loaded from a file.
+// Problems that have already been described are returned unchanged.
+func (gen *generator) error(node *html.Node, err error) error {
+	var e *htmpl.Error
+	if node == nil || errors.As(err, &e) {
+		return err
+	}
+	root := node
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	p := gen.pos[node]
+	return &htmpl.Error{Name: gen.names[root], Node: node, Line: p.Line, Col: p.Col, Err: err}
+}
+
+func (gen *generator) genCode(node *html.Node) (err error) {
+	if node.Type == html.ElementNode {
+		parent := gen.node
+		gen.node = node
+		defer func() {
+			gen.node = parent
+			if err != nil {
+				err = gen.error(node, err)
+			}
+		}()
+	}
+
 	switch node.Type {
 	case html.DocumentNode:
 		if err := gen.genChildren(node); err != nil {
@@ -109,51 +292,112 @@ func (gen *generator) genCode(node *html.Node) error {
 	case html.ElementNode:
 		switch node.Data {
 		case "if", "nif":
-			gen.WriteString("if ")
-			if node.Data == "nif" {
-				gen.WriteString("!(")
-			}
-			gen.genTruthy(getAttr(node, "v"))
-			if node.Data == "nif" {
-				gen.WriteByte(')')
+			if err := gen.genCond(node, nil); err != nil {
+				return err
 			}
-			gen.WriteString(" {\n")
-			if err := gen.genChildren(node); err != nil {
+
+		case "elif", "else":
+			return fmt.Errorf("<%s> must follow <if>, <nif> or <elif>", node.Data)
+
+		case "switch":
+			if err := gen.genSwitch(node); err != nil {
 				return err
 			}
-			gen.WriteString("}\n")
+
+		case "case", "default":
+			return fmt.Errorf("<%s> must be within <switch>", node.Data)
 
 		case "for":
-			elemTy := gen.genLoop(getAttr(node, "v"))
-			if elemTy != nil {
-				gen.pushTy(".", elemTy)
-				if err := gen.genChildren(node); err != nil {
-					return err
-				}
-				gen.popTy(".")
-				gen.WriteString("}\n")
+			if err := gen.genFor(node); err != nil {
+				return err
 			}
 
 		case "let":
-			valName, valTy := gen.get(getAttr(node, "val"))
-			varName := gen.name(getAttr(node, "var"))
+			valName, valTy := gen.value(getAttr(node, "val"))
+			varName := getAttr(node, "var")
+			if varName == "loop" {
+				return fmt.Errorf("variable %q is reserved", varName)
+			}
 			gen.WriteString("if true {\n")
-			gen.Printf("%s := %s\n_ = %[0]s\n", varName, valName)
+			if valTy != nil {
+				gen.Printf("%s := %s\n_ = %[1]s\n", gen.name(varName), valName)
+			}
 			gen.pushTy(varName, valTy)
-			gen.genChildren(node)
+			if err := gen.genChildren(node); err != nil {
+				return err
+			}
 			gen.popTy(varName)
 			gen.WriteString("}\n")
 
+		case "include":
+			if err := gen.genInclude(node); err != nil {
+				return err
+			}
+
+		case "extends":
+			if err := gen.genExtends(node); err != nil {
+				return err
+			}
+
+		case "block":
+			name := getAttr(node, "name")
+			o := gen.overrides[name]
+			if o == nil {
+				return gen.genChildren(node)
+			}
+
+			// Generate the overriding content, which cannot itself be overridden with the same name
+			o.used = true
+			overrides := gen.overrides
+			gen.overrides = make(map[string]*override, len(overrides))
+			for n, o := range overrides {
+				if n != name {
+					gen.overrides[n] = o
+				}
+			}
+			err := gen.genChildren(o.node)
+			gen.overrides = overrides
+			if err != nil {
+				return err
+			}
+
+		case "define":
+			// Generated where the component is used
+
+		case "slot":
+			if len(gen.slots) > 0 {
+				if fn, ok := gen.slots[len(gen.slots)-1][getAttr(node, "name")]; ok {
+					gen.Printf("out = append(out, %s()...)\n", fn)
+					break
+				}
+			}
+			if err := gen.genChildren(node); err != nil {
+				return err
+			}
+
 		case "v":
 			// FIXME: should handle multiple child nodes
 			if node.FirstChild != nil && node.FirstChild.Type == html.TextNode {
 				path := node.FirstChild.Data
+				if gen.trusted(path) == htmpl.ContextText {
+					// Trusted HTML is substituted as HTML
+					name, _ := gen.expr(path)
+					gen.Printf("out = append(out, gen.ParseHTML(string(%s), nil)...)\n", name)
+					break
+				}
+				if _, noescape := getAttrOk(node, "noescape"); noescape {
+					gen.genNoescape(path)
+					break
+				}
 				gen.WriteString("out = append(out, &html.Node{Type: html.TextNode, Data: ")
 				gen.genStringify(path)
 				gen.WriteString("})\n")
 			}
 
 		default:
+			if def := gen.components[node.Data]; def != nil {
+				return gen.genComponent(def, node)
+			}
 			if err := gen.genElement(node); err != nil {
 				return err
 			}
@@ -166,112 +410,785 @@ func (gen *generator) genCode(node *html.Node) error {
 }
 
 func (gen *generator) genChildren(node *html.Node) error {
+	var nodes []*html.Node
 	for child := node.FirstChild; child != nil; child = child.NextSibling {
-		if err := gen.genCode(child); err != nil {
+		nodes = append(nodes, child)
+	}
+	return gen.genSequence(nodes)
+}
+
+// genSequence generates code for a sequence of sibling nodes.
+// <elif> and <else> elements following a conditional element are generated as branches of it, ignoring whitespace and comments between them.
+func (gen *generator) genSequence(nodes []*html.Node) error {
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+		if node.Type != html.ElementNode || node.Data != "if" && node.Data != "nif" {
+			if err := gen.genCode(node); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var branches []*html.Node
+		for j := i + 1; j < len(nodes); j++ {
+			if isBranch(nodes[j]) {
+				branches = append(branches, nodes[j])
+				i = j
+			} else if !isBlank(nodes[j]) {
+				break
+			}
+		}
+		if err := gen.genCond(node, branches); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// genCond generates an if statement for a conditional element.
+// Its branches are the <elif> and <else> elements at the end of its body, followed by the given sibling branches.
+func (gen *generator) genCond(node *html.Node, siblings []*html.Node) error {
+	var body, branches []*html.Node
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case isBranch(child):
+			branches = append(branches, child)
+		case len(branches) == 0:
+			body = append(body, child)
+		case !isBlank(child):
+			return fmt.Errorf("<%s> must not contain content after <%s>", node.Data, branches[len(branches)-1].Data)
+		}
+	}
+
+	gen.WriteString("if ")
+	if node.Data == "nif" {
+		gen.WriteString("!(")
+	}
+	gen.genTruthy(getAttr(node, "v"))
+	if node.Data == "nif" {
+		gen.WriteByte(')')
+	}
+	gen.WriteString(" {\n")
+	if err := gen.genSequence(body); err != nil {
+		return err
+	}
+
+	els := false
+	for _, branch := range append(branches, siblings...) {
+		if els {
+			return fmt.Errorf("<%s> must not follow <else>", branch.Data)
+		}
+		if branch.Data == "else" {
+			gen.WriteString("} else {\n")
+			els = true
+		} else {
+			gen.WriteString("} else if ")
+			gen.genTruthy(getAttr(branch, "v"))
+			gen.WriteString(" {\n")
+		}
+		if err := gen.genChildren(branch); err != nil {
 			return err
 		}
 	}
+	gen.WriteString("}\n")
 	return nil
 }
 
-func (gen *generator) genTruthy(name string) {
-	name, ty := gen.get(name)
+// genSwitch generates a switch statement for a <switch> element
+func (gen *generator) genSwitch(node *html.Node) error {
+	valName, valTy := gen.expr(getAttr(node, "v"))
+	gen.WriteString("if true {\n")
+	if valTy != nil {
+		gen.Printf("sw := %s\n_ = sw\n", valName)
+		valName = "sw"
+	}
+	gen.WriteString("switch {\n")
+	hasDefault := false
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.Type == html.ElementNode && child.Data == "case":
+			gen.WriteString("case ")
+			if is, ok := getAttrOk(child, "is"); ok {
+				gen.Printf("%s == %q", stringify(valName, valTy), is)
+			} else if src, ok := getAttrOk(child, "v"); ok {
+				otherName, otherTy := gen.expr(src)
+				gen.WriteString(compare("==", operand{code: valName, ty: valTy}, operand{code: otherName, ty: otherTy}))
+			} else {
+				return errors.New("<case> must have an is or v attribute")
+			}
+			gen.WriteString(":\n")
+		case child.Type == html.ElementNode && child.Data == "default":
+			if hasDefault {
+				return errors.New("<switch> must not contain multiple <default> elements")
+			}
+			hasDefault = true
+			gen.WriteString("default:\n")
+		case isBlank(child):
+			continue
+		default:
+			return errors.New("<switch> may only contain <case> and <default> elements")
+		}
+		if err := gen.genChildren(child); err != nil {
+			return err
+		}
+	}
+	gen.WriteString("}\n}\n")
+	return nil
+}
+
+// isBranch returns true if a node is an <elif> or <else> element
+func isBranch(node *html.Node) bool {
+	return node.Type == html.ElementNode && (node.Data == "elif" || node.Data == "else")
+}
+
+// isBlank returns true if a node is a comment or whitespace
+func isBlank(node *html.Node) bool {
+	return node.Type == html.CommentNode || node.Type == html.TextNode && strings.TrimSpace(node.Data) == ""
+}
+
+// genInclude generates code for another template, loaded from the configured file system
+func (gen *generator) genInclude(node *html.Node) error {
+	src := getAttr(node, "src")
+	for _, name := range gen.stack {
+		if name == src {
+			return fmt.Errorf("template %q includes itself", src)
+		}
+	}
+	partial, err := gen.load(src)
+	if err != nil {
+		return err
+	}
+
+	gen.WriteString("if true {\n")
+	dotName, dotTy := "dot", gen.ty(".")
+	if path := getAttr(node, "dot"); path != "" {
+		dotName, dotTy = gen.value(path)
+	}
+	if dotTy != nil {
+		gen.Printf("dot := %s\ndollar := dot\n_, _ = dot, dollar\n", dotName)
+	}
+	gen.pushTy(".", dotTy)
+	gen.pushTy("$", dotTy)
+	gen.stack = append(gen.stack, src)
+	if err := gen.genCode(partial); err != nil {
+		return err
+	}
+	gen.stack = gen.stack[:len(gen.stack)-1]
+	gen.popTy("$")
+	gen.popTy(".")
+	gen.WriteString("}\n")
+	return nil
+}
+
+// define finds the components defined by a template and the templates it includes or extends.
+// Components defined in a template take precedence over those it includes.
+func (gen *generator) define(root *html.Node, seen map[*html.Node]bool) error {
+	if seen[root] {
+		return nil
+	}
+	seen[root] = true
+	if gen.components == nil {
+		gen.components = make(map[string]*html.Node)
+	}
+
+	var defs []*html.Node
+	var find func(node *html.Node) error
+	find = func(node *html.Node) error {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch child.Data {
+			case "define":
+				defs = append(defs, child)
+				continue
+			case "include", "extends":
+				partial, err := gen.load(getAttr(child, "src"))
+				if err != nil {
+					return gen.error(child, err)
+				}
+				if err := gen.define(partial, seen); err != nil {
+					return err
+				}
+			}
+			if err := find(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := find(root); err != nil {
+		return err
+	}
+
+	defined := make(map[string]bool)
+	for _, def := range defs {
+		name := strings.ToLower(getAttr(def, "name"))
+		switch {
+		case name == "":
+			return gen.error(def, errors.New("<define> must have a name attribute"))
+		case builtins[name]:
+			return gen.error(def, fmt.Errorf("cannot define built-in element <%s>", name))
+		case defined[name]:
+			return gen.error(def, fmt.Errorf("component %q is already defined", name))
+		}
+		defined[name] = true
+		gen.components[name] = def
+	}
+	return nil
+}
+
+// builtins is the set of elements that cannot be defined as components
+var builtins = map[string]bool{
+	"block":   true,
+	"case":    true,
+	"default": true,
+	"define":  true,
+	"elif":    true,
+	"else":    true,
+	"extends": true,
+	"for":     true,
+	"if":      true,
+	"include": true,
+	"let":     true,
+	"nif":     true,
+	"slot":    true,
+	"switch":  true,
+	"v":       true,
+}
+
+// genComponent generates code for a use of a component.
+// The component is generated as a function, which is passed the variables in scope as the evaluator's components see them,
+// so that uses of a component within itself can call the same function.
+// Slot content is generated as functions, so it is evaluated in the scope of the caller.
+func (gen *generator) genComponent(def, node *html.Node) error {
+	gen.WriteString("if true {\n")
+	slots := make(map[string]string)
+	var names []string
+	content := make(map[string][]*html.Node)
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		name := ""
+		if child.Type == html.ElementNode {
+			name = getAttr(child, "slot")
+		}
+		if _, ok := content[name]; !ok {
+			names = append(names, name)
+		}
+		content[name] = append(content[name], child)
+	}
+	var slotArgs []string
+	for _, name := range names {
+		// Slots containing only whitespace and comments are considered empty
+		filled := false
+		for _, child := range content[name] {
+			if !isBlank(child) {
+				filled = true
+			}
+		}
+		if !filled {
+			continue
+		}
+
+		fn := fmt.Sprintf("slot%d", gen.nslots)
+		gen.nslots++
+		slots[name] = fmt.Sprintf("componentSlots[%q]", name)
+		slotArgs = append(slotArgs, fmt.Sprintf("%q: %s", name, fn))
+		gen.Printf("%s := func() (out []*html.Node) {\n", fn)
+		if err := gen.genSequence(content[name]); err != nil {
+			return err
+		}
+		gen.WriteString("return\n}\n")
+	}
+
+	var bound []string
+	for _, attr := range node.Attr {
+		// Attributes with a "v:" prefix contain a variable path, and others are strings
+		key := strings.TrimPrefix(attr.Key, "v:")
+		var valName string
+		var valTy types.Type
+		switch {
+		case key != attr.Key:
+			valName, valTy = gen.value(attr.Val)
+		case key == "slot":
+			continue
+		default:
+			valName, valTy = strconv.Quote(attr.Val), types.Typ[types.String]
+		}
+		if valTy != nil {
+			gen.Printf("%s := %s\n_ = %[1]s\n", gen.name(key), valName)
+		}
+		gen.pushTy(key, valTy)
+		bound = append(bound, key)
+	}
+
+	// Pass each variable in scope, so the component sees the variables where it is used
+	var vars []string
+	for name, tys := range gen.types {
+		if len(tys) > 0 && tys[len(tys)-1] != nil {
+			vars = append(vars, name)
+		}
+	}
+	sort.Strings(vars)
+	params := make([]string, len(vars))
+	args := make([]string, len(vars))
+	for i, name := range vars {
+		typ := gen.varTypeString(name)
+		params[i] = gen.name(name) + " " + typ
+		// Convert the arguments, as the types of unwrapped values may be unnamed
+		args[i] = fmt.Sprintf("(%s)(%s)", typ, gen.name(name))
+	}
+	sort.Strings(slotArgs)
+	params = append(params, "componentSlots map[string]func() []*html.Node")
+	args = append(args, fmt.Sprintf("map[string]func() []*html.Node{%s}", strings.Join(slotArgs, ", ")))
+	key := fmt.Sprintf("%s(%s)%v", node.Data, strings.Join(params, ", "), slotArgs)
+
+	fn := ""
+	for _, call := range gen.calls {
+		if call.key == key {
+			fn = call.fn
+		}
+	}
+	if fn == "" {
+		if len(gen.calls) >= maxComponentDepth {
+			return fmt.Errorf("component %q is nested too deeply", node.Data)
+		}
+		fn = fmt.Sprintf("component%d", gen.ncomponents)
+		gen.ncomponents++
+		sig := fmt.Sprintf("func(%s)", strings.Join(params, ", "))
+		gen.Printf("var %s %s []*html.Node\n", fn, sig)
+		gen.Printf("%s = %s (out []*html.Node) {\n", fn, sig)
+		gen.calls = append(gen.calls, componentCall{key, fn})
+		gen.slots = append(gen.slots, slots)
+		if err := gen.genChildren(def); err != nil {
+			return err
+		}
+		gen.slots = gen.slots[:len(gen.slots)-1]
+		gen.calls = gen.calls[:len(gen.calls)-1]
+		gen.WriteString("return\n}\n")
+	}
+	gen.Printf("out = append(out, %s(%s)...)\n", fn, strings.Join(args, ", "))
+
+	for _, name := range bound {
+		gen.popTy(name)
+	}
+	gen.WriteString("}\n")
+	return nil
+}
+
+// maxComponentDepth limits the number of functions generated for components within each other,
+// in case the types of the variables used by a recursive component never repeat
+const maxComponentDepth = 100
+
+// varTypeString returns the name of the type of a variable, as declared in the generated code
+func (gen *generator) varTypeString(name string) string {
+	ty := gen.ty(name)
+	if name == "loop" {
+		// The loop variable is a gen.Loop, rather than the struct type used to index it
+		s := ty.(*types.Struct)
+		return fmt.Sprintf("gen.Loop[%s, %s]", gen.typeString(s.Field(5).Type()), gen.typeString(s.Field(6).Type()))
+	}
+	return gen.typeString(ty)
+}
+
+// genExtends generates code for a layout, replacing its blocks with those within the <extends> element
+func (gen *generator) genExtends(node *html.Node) error {
+	src := getAttr(node, "src")
+	for _, name := range gen.stack {
+		if name == src {
+			return fmt.Errorf("template %q includes itself", src)
+		}
+	}
+	layout, err := gen.load(src)
+	if err != nil {
+		return err
+	}
+
+	var blocks []*override
+	overrides := make(map[string]*override)
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.Type == html.ElementNode && child.Data == "block":
+			o := &override{node: child}
+			blocks = append(blocks, o)
+			overrides[getAttr(child, "name")] = o
+		case isBlank(child):
+		default:
+			return errors.New("<extends> may only contain <block> elements")
+		}
+	}
+	// Overrides from templates extending this one take precedence
+	for name, o := range gen.overrides {
+		overrides[name] = o
+	}
+
+	prevOverrides := gen.overrides
+	gen.overrides = overrides
+	gen.stack = append(gen.stack, src)
+	if err := gen.genCode(layout); err != nil {
+		return err
+	}
+	gen.stack = gen.stack[:len(gen.stack)-1]
+	gen.overrides = prevOverrides
+
+	for _, o := range blocks {
+		name := getAttr(o.node, "name")
+		// Blocks replaced by another override are defined if their replacement was used
+		if !overrides[name].used {
+			return fmt.Errorf("block %q is not defined in %q", name, src)
+		}
+	}
+	return nil
+}
+
+// load loads and parses a template by name
+func (gen *generator) load(name string) (*html.Node, error) {
+	if node := gen.partials[name]; node != nil {
+		return node, nil
+	}
+	if gen.config.FS == nil {
+		return nil, fmt.Errorf("cannot load template %q: no file system configured", name)
+	}
+	src, err := fs.ReadFile(gen.config.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	node := &html.Node{Type: html.DocumentNode}
+	if err := htmlparse.Parse(node, src); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if gen.partials == nil {
+		gen.partials = make(map[string]*html.Node)
+		gen.pos = make(map[*html.Node]htmlpos.Position)
+		gen.names = make(map[*html.Node]string)
+	}
+	gen.partials[name] = node
+	for n, p := range htmlpos.Locate(src, node) {
+		gen.pos[n] = p
+	}
+	gen.names[node] = name
+	return node, nil
+}
+
+// genTruthy generates a condition that is true iff the value of src is truthy.
+// Nil pointers are falsey, rather than being dereferenced, so pointers are bound to a variable and checked first.
+func (gen *generator) genTruthy(src string) {
+	name, ty := gen.value(src)
 	if ty == nil {
-		gen.WriteString("false")
+		gen.WriteString(truthy(name, ty))
 		return
 	}
+	var checks []string
+	for p, ok := ty.Underlying().(*types.Pointer); ok; p, ok = p.Elem().Underlying().(*types.Pointer) {
+		checks = append(checks, strings.Repeat("*", len(checks))+"p != nil")
+		ty = p.Elem()
+	}
+	if len(checks) == 0 {
+		gen.WriteString(truthy(name, ty.Underlying()))
+		return
+	}
+	elem := "(" + strings.Repeat("*", len(checks)) + "p)"
+	gen.Printf("func() bool {\np := %s\nreturn %s && %s\n}()", name, strings.Join(checks, " && "), truthy(elem, ty.Underlying()))
+}
+
+// truthy returns an expression that is true iff the Go expression name of type ty is truthy
+func truthy(name string, ty types.Type) string {
+	if ty == nil {
+		return "false"
+	}
 	switch ty := ty.(type) {
 	case *types.Array, *types.Slice:
-		gen.Printf("len(%s) > 0", name)
+		return fmt.Sprintf("len(%s) > 0", name)
 	case *types.Basic:
 		info := ty.Info()
 		if info&types.IsBoolean != 0 {
-			gen.WriteString(name)
+			return name
 		} else if info&types.IsNumeric != 0 {
-			gen.Printf("%s != 0", name)
+			return fmt.Sprintf("%s != 0", name)
 		} else if info&types.IsString != 0 {
-			gen.Printf(`%s != ""`, name)
+			return fmt.Sprintf(`%s != ""`, name)
+		} else {
+			return fmt.Sprintf("%s != nil", name)
 		}
-		panic("Unknown basic type " + ty.String())
-	case *types.Chan:
-		fmt.Printf("%s != nil", name)
+	case *types.Chan, *types.Signature:
+		return fmt.Sprintf("%s != nil", name)
 	case *types.Map, *types.Struct:
-		fmt.Printf("true")
+		return "true"
 	default:
-		panic("Unknown type " + ty.String())
+		return fmt.Sprintf("htmpl.Truthy(%s)", name)
 	}
 }
 
-func (gen *generator) genLoop(name string) (elemTy types.Type) {
-	name, ty := gen.get(name)
+// genFor generates code for a <for> element
+func (gen *generator) genFor(node *html.Node) error {
+	for _, attr := range []string{"key", "val"} {
+		if name := getAttr(node, attr); name == "loop" {
+			return fmt.Errorf("variable %q is reserved", name)
+		}
+	}
+	if _, ok := getAttrOk(node, "to"); ok {
+		return gen.genRange(node)
+	}
+	name, ty := gen.expr(getAttr(node, "v"))
 	if ty == nil {
 		return nil
 	}
+	gen.Printf("if true {\nloopColl, loopIndex := %s, 0\n_, _ = loopColl, loopIndex\n", name)
+
+	if ty, ok := ty.(*types.Struct); ok {
+		// Each field may have a different type, so the body is generated for each
+		fs := gen.fields(ty)
+		length := strconv.Itoa(len(fs))
+		for _, f := range fs {
+			code, fty := gen.fieldByIndex("loopColl", ty, f)
+			gen.Printf("if true {\ndot := %s\nkey, value := %q, dot\n", code, f.name)
+			if err := gen.genIteration(node, length, types.Typ[types.String], fty, fty); err != nil {
+				return err
+			}
+			gen.WriteString("}\n")
+		}
+		gen.WriteString("}\n")
+		return nil
+	}
+
+	length := "len(loopColl)"
+	var elemTy, keyTy, valueTy types.Type
 	switch ty := ty.(type) {
 	case *types.Array:
-		gen.Printf("for _, dot := range %s {_=dot\n", name)
-		return ty.Elem()
+		gen.WriteString("for _, dot := range loopColl {\nkey, value := loopIndex, dot\n")
+		elemTy, keyTy, valueTy = ty.Elem(), types.Typ[types.Int], ty.Elem()
 	case *types.Slice:
-		gen.Printf("for _, dot := range %s {_=dot\n", name)
-		return ty.Elem()
-	case *types.Basic:
-		gen.Printf("if true {\ndot := %s\n_=dot\n", name)
-		return ty
+		gen.WriteString("for _, dot := range loopColl {\nkey, value := loopIndex, dot\n")
+		elemTy, keyTy, valueTy = ty.Elem(), types.Typ[types.Int], ty.Elem()
+	case *types.Basic, *types.Signature:
+		gen.WriteString("if true {\ndot := loopColl\nkey, value := loopIndex, dot\n")
+		length = "1"
+		elemTy, keyTy, valueTy = ty, types.Typ[types.Int], ty
 	case *types.Chan:
-		gen.Printf("for dot := range %s {_=dot\n", name)
-		return ty.Elem()
+		gen.WriteString("for dot := range loopColl {\nkey, value := loopIndex, dot\n")
+		length = "0"
+		elemTy, keyTy, valueTy = ty.Elem(), types.Typ[types.Int], ty.Elem()
 	case *types.Map:
-		gen.Printf("for dot := range %s {_=dot\n", name)
-		return ty.Key()
-	case *types.Struct:
-		gen.WriteString("for _, dot := range []string{")
-		for i := 0; i < ty.NumFields(); i++ {
-			// TODO: handle embedded fields
-			gen.Printf("%q,", ty.Field(i).Name())
+		if _, sorted := getAttrOk(node, "sort"); sorted || gen.config.SortMaps {
+			gen.WriteString("for _, key := range gen.SortedKeys(loopColl) {\nvalue := loopColl[key]\n")
+		} else {
+			gen.WriteString("for key, value := range loopColl {\n")
 		}
-		gen.WriteString("} {_=dot\n")
-		return types.Typ[types.String]
+		gen.WriteString("dot := key\n")
+		elemTy, keyTy, valueTy = ty.Key(), ty.Key(), ty.Elem()
+	case *types.Interface:
+		return fmt.Errorf("cannot iterate over %s: values of interface types are not supported in generated code", ty)
 	default:
-		panic("Unknown type " + ty.String())
+		return fmt.Errorf("cannot iterate over %s", ty)
+	}
+	if err := gen.genIteration(node, length, keyTy, valueTy, elemTy); err != nil {
+		return err
 	}
+	gen.WriteString("}\n}\n")
+	return nil
 }
 
-func (gen *generator) genStringify(name string) {
-	name, ty := gen.get(name)
+// genRange generates a counted loop for a <for> element iterating over a numeric range
+func (gen *generator) genRange(node *html.Node) error {
+	if _, ok := getAttrOk(node, "v"); ok {
+		return errors.New("<for> must not have both v and to attributes")
+	}
+	bounds := map[string]string{"from": "1", "to": "0", "step": "1"}
+	for _, attr := range []string{"from", "to", "step"} {
+		src, ok := getAttrOk(node, attr)
+		if !ok {
+			continue
+		}
+		x := gen.operand(src)
+		if x.ty == nil {
+			// An empty bound is treated as 0
+			bounds[attr] = "0"
+			continue
+		}
+		if x.constant && x.ty == types.Typ[types.Float64] {
+			// Constant bounds are checked as the evaluator checks them, as converting them to int may not compile
+			f, _ := strconv.ParseFloat(x.code, 64)
+			switch {
+			case f != math.Trunc(f):
+				return fmt.Errorf("<for> attribute %q: %s is not an integer", attr, strconv.FormatFloat(f, 'g', -1, 64))
+			case f < math.MinInt || f >= math.MaxInt:
+				return fmt.Errorf("<for> attribute %q: %s is out of range", attr, strconv.FormatFloat(f, 'g', -1, 64))
+			}
+			x = operand{code: strconv.Itoa(int(f)), ty: types.Typ[types.Int], constant: true}
+		}
+		if attr == "step" && x.constant && x.code == "0" {
+			return errors.New("<for> attribute \"step\": step must not be zero")
+		}
+		code, err := gen.arg(x, types.Typ[types.Int])
+		if err != nil {
+			return fmt.Errorf("<for> attribute %q: %w", attr, err)
+		}
+		bounds[attr] = code
+	}
+
+	gen.Printf("if true {\nloopFrom, loopStep := %s, %s\n", bounds["from"], bounds["step"])
+	gen.Printf("loopIndex, loopLength := 0, gen.RangeLength(loopFrom, %s, loopStep)\n", bounds["to"])
+	gen.WriteString("for dot := loopFrom; loopIndex < loopLength; dot += loopStep {\nkey, value := loopIndex, dot\n")
+	intTy := types.Typ[types.Int]
+	if err := gen.genIteration(node, "loopLength", intTy, intTy, intTy); err != nil {
+		return err
+	}
+	gen.WriteString("}\n}\n")
+	return nil
+}
+
+// genIteration generates the body of a <for> element for a single item.
+// The generated code must already have declared dot, key and value for the item.
+func (gen *generator) genIteration(node *html.Node, length string, keyTy, valueTy, elemTy types.Type) error {
+	gen.Printf("var_loop := gen.NewLoop(loopIndex, %s, key, value)\nloopIndex++\n_, _ = dot, var_loop\n", length)
+	vars := []string{".", "loop"}
+	gen.pushTy(".", elemTy)
+	gen.pushTy("loop", loopType(keyTy, valueTy))
+	if name := getAttr(node, "key"); name != "" {
+		gen.Printf("%s := key\n_ = %[1]s\n", gen.name(name))
+		gen.pushTy(name, keyTy)
+		vars = append(vars, name)
+	}
+	if name := getAttr(node, "val"); name != "" {
+		gen.Printf("%s := value\n_ = %[1]s\n", gen.name(name))
+		gen.pushTy(name, valueTy)
+		vars = append(vars, name)
+	}
+	if err := gen.genChildren(node); err != nil {
+		return err
+	}
+	for _, name := range vars {
+		gen.popTy(name)
+	}
+	return nil
+}
+
+// loopType returns the type of the loop variable, given the types of the keys and values of the collection
+func loopType(keyTy, valueTy types.Type) types.Type {
+	intTy, boolTy := types.Typ[types.Int], types.Typ[types.Bool]
+	return types.NewStruct([]*types.Var{
+		types.NewField(0, nil, "Index", intTy, false),
+		types.NewField(0, nil, "Number", intTy, false),
+		types.NewField(0, nil, "Length", intTy, false),
+		types.NewField(0, nil, "First", boolTy, false),
+		types.NewField(0, nil, "Last", boolTy, false),
+		types.NewField(0, nil, "Key", keyTy, false),
+		types.NewField(0, nil, "Value", valueTy, false),
+	}, nil)
+}
+
+func (gen *generator) genStringify(src string) {
+	gen.WriteString(gen.stringValue(src))
+}
+
+// stringValue returns an expression converting the value of src to a string.
+// Pointers are followed when the code is run, so nil pointers are empty, and nodes are rendered as HTML.
+func (gen *generator) stringValue(src string) string {
+	if rawName, raw := gen.value(src); raw != nil {
+		if _, ok := raw.Underlying().(*types.Pointer); ok || isNodeType(raw) || isNodeSlice(raw) {
+			return fmt.Sprintf("gen.Stringify(%s)", rawName)
+		}
+	}
+	return stringify(gen.expr(src))
+}
+
+// stringify returns an expression converting the Go expression name of type ty to a string
+func stringify(name string, ty types.Type) string {
 	if ty == nil {
-		gen.WriteString(`""`)
-		return
+		return `""`
 	}
 	switch ty := ty.(type) {
 	case *types.Array, *types.Slice, *types.Chan, *types.Map, *types.Struct:
-		gen.Printf("fmt.Sprint(%s)", name)
+		return fmt.Sprintf("fmt.Sprint(%s)", name)
 	case *types.Basic:
 		if ty.Info()&types.IsString != 0 {
-			gen.WriteString(name)
-		} else {
-			gen.Printf("fmt.Sprint(%s)", name)
+			// Convert in case the type is named
+			return fmt.Sprintf("string(%s)", name)
 		}
+		return fmt.Sprintf("fmt.Sprint(%s)", name)
 	default:
-		panic("Unknown type " + ty.String())
+		return fmt.Sprintf("gen.Stringify(%s)", name)
 	}
 }
 
+// genNoescape generates code to substitute the value of src as HTML, as <v noescape> does.
+// Values that are already nodes are copied, and all other values are converted to strings and parsed when the code is run.
+func (gen *generator) genNoescape(src string) {
+	x := gen.operand(src)
+	name, ty := x.code, x.ty
+	if ty == nil {
+		return
+	}
+	_, raw := gen.value(src)
+	raw = deref(raw)
+	switch {
+	case isNodeType(raw) && x.addr != "":
+		// Nil pointers to nodes are empty
+		gen.Printf("if p := %s; p != nil {\nout = append(out, gen.CloneNode(*p))\n}\n", x.addr)
+	case isNodeType(raw):
+		gen.Printf("out = append(out, gen.CloneNode(%s))\n", name)
+	case isNodeSlice(raw):
+		gen.Printf("out = append(out, gen.CloneNodes(%s)...)\n", name)
+	default:
+		policy := gen.config.Policy
+		if policy == "" {
+			policy = "nil"
+		}
+		gen.Printf("out = append(out, gen.ParseHTML(%s, %s)...)\n", stringify(name, ty), policy)
+	}
+}
+
+// isNodeType returns true if ty is html.Node
+func isNodeType(ty types.Type) bool {
+	named, ok := ty.(*types.Named)
+	return ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() == "golang.org/x/net/html" && named.Obj().Name() == "Node"
+}
+
+// deref follows pointers from ty, returning the type of the value they point to.
+// Aliases are resolved, so the type can be compared with named types.
+func deref(ty types.Type) types.Type {
+	ty = types.Unalias(ty)
+	for {
+		p, ok := ty.(*types.Pointer)
+		if !ok {
+			return ty
+		}
+		ty = types.Unalias(p.Elem())
+	}
+}
+
+// isNodeSlice returns true if ty is []*html.Node, but not a named type with the same underlying type, as htmpl.Evaluate requires
+func isNodeSlice(ty types.Type) bool {
+	s, ok := ty.(*types.Slice)
+	if !ok {
+		return false
+	}
+	p, ok := s.Elem().(*types.Pointer)
+	return ok && isNodeType(types.Unalias(p.Elem()))
+}
+
 func (gen *generator) genElement(node *html.Node) error {
 	gen.WriteString("out = append(out, func() *html.Node {\n")
 	gen.WriteString("var out []*html.Node\n")
-	if err := gen.genChildren(node); err != nil {
+	rawText := isRawText(node)
+	if rawText {
+		if err := gen.genRawText(node); err != nil {
+			return err
+		}
+	} else if err := gen.genChildren(node); err != nil {
 		return err
 	}
 
-	gen.Printf("outNode := &html.Node{Type: html.ElementNode, DataAtom: %d, Data: %q, ", node.DataAtom, node.Data)
-	if len(node.Attr) != 0 {
-		gen.WriteString("Attr: []html.Attribute{")
-		for _, attr := range node.Attr {
-			gen.Printf("{Namespace: %q, Key: %q, Val: %q},", attr.Namespace, attr.Key, attr.Val)
+	gen.Printf("outNode := &html.Node{Type: html.ElementNode, DataAtom: %d, Data: %q}\n", node.DataAtom, node.Data)
+	for _, attr := range node.Attr {
+		if rawText && attr.Namespace == "" && attr.Key == "v" {
+			continue
+		}
+		if key := strings.TrimPrefix(attr.Key, "v:"); key != attr.Key {
+			gen.genAttr(attr.Namespace, key, attr.Val)
+		} else {
+			gen.Printf("outNode.Attr = append(outNode.Attr, html.Attribute{Namespace: %q, Key: %q, Val: %q})\n", attr.Namespace, attr.Key, attr.Val)
 		}
-		gen.WriteString("}")
 	}
-	gen.WriteString("}\n")
 
 	gen.WriteString("for _, child := range out {\n")
 	gen.WriteString("outNode.AppendChild(child)\n")
@@ -282,10 +1199,150 @@ func (gen *generator) genElement(node *html.Node) error {
 	return nil
 }
 
+// genAttr generates code to add an attribute whose value is substituted from an expression
+func (gen *generator) genAttr(namespace, key, src string) {
+	if rawName, raw := gen.value(src); raw != nil {
+		if p, ok := raw.Underlying().(*types.Pointer); ok {
+			// Attributes whose values are nil pointers are empty, so they are omitted.
+			// The value is bound to a variable, so the pointer is only evaluated once.
+			gen.Printf("if p := %s; p != nil {\n%s := *p\n", rawName, gen.name("attr"))
+			gen.pushTy("attr", p.Elem())
+			gen.genAttr(namespace, key, "attr")
+			gen.popTy("attr")
+			gen.WriteString("}\n")
+			return
+		}
+	}
+	name, ty := gen.expr(src)
+	if ty == nil {
+		return
+	}
+	if ty, ok := ty.(*types.Basic); ok && ty.Info()&types.IsBoolean != 0 {
+		// Boolean attributes are present iff the value is true
+		gen.Printf("if %s {\n", name)
+		gen.Printf("outNode.Attr = append(outNode.Attr, html.Attribute{Namespace: %q, Key: %q})\n", namespace, key)
+		gen.WriteString("}\n")
+		return
+	}
+	gen.Printf("outNode.Attr = append(outNode.Attr, html.Attribute{Namespace: %q, Key: %q, Val: %s})\n", namespace, key, gen.escape(htmpl.AttrContext(key), src))
+}
+
+// isRawText returns true if a node is a <script v> or <style v> element, whose text may contain <v> elements
+func isRawText(node *html.Node) bool {
+	if node.Data != "script" && node.Data != "style" {
+		return false
+	}
+	_, ok := getAttrOk(node, "v")
+	return ok
+}
+
+// genRawText generates code for the content of a <script v> or <style v> element, substituting the <v> elements within its text
+func (gen *generator) genRawText(node *html.Node) error {
+	child := node.FirstChild
+	if child == nil || child.NextSibling != nil || child.Type != html.TextNode {
+		return gen.genChildren(node)
+	}
+	parts, err := htmlcontext.Split(node.Data, child.Data)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if part.Path == "" {
+			gen.Printf("out = append(out, &html.Node{Type: html.TextNode, Data: %q})\n", part.Text)
+			continue
+		}
+		gen.Printf("out = append(out, &html.Node{Type: html.TextNode, Data: %s})\n", gen.escape(part.Context, part.Path))
+	}
+	return nil
+}
+
+// contextNames maps each context to the name of its constant in the generated code
+var contextNames = map[htmpl.Context]string{
+	htmpl.ContextText:      "htmpl.ContextText",
+	htmpl.ContextURL:       "htmpl.ContextURL",
+	htmpl.ContextJS:        "htmpl.ContextJS",
+	htmpl.ContextJSString:  "htmpl.ContextJSString",
+	htmpl.ContextJSRegexp:  "htmpl.ContextJSRegexp",
+	htmpl.ContextCSS:       "htmpl.ContextCSS",
+	htmpl.ContextCSSString: "htmpl.ContextCSSString",
+	htmpl.ContextCSSURL:    "htmpl.ContextCSSURL",
+	htmpl.ContextComment:   "htmpl.ContextComment",
+	htmpl.ContextHTML:      "htmpl.ContextHTML",
+}
+
+// escape returns an expression escaping the value of src for use in the given context.
+// JavaScript values are encoded from the value itself, so nil pointers become null,
+// and values of trusted types are passed as they are, so htmpl.Escape can recognise them.
+// All other values are converted to strings first.
+func (gen *generator) escape(ctx htmpl.Context, src string) string {
+	if ctx == htmpl.ContextJS {
+		name, ty := gen.value(src)
+		if ty == nil {
+			return `""`
+		}
+		return fmt.Sprintf("htmpl.Escape(%s, %s)", contextNames[ctx], name)
+	}
+	name, ty := gen.expr(src)
+	if ty == nil || ctx == htmpl.ContextText {
+		return gen.stringValue(src)
+	}
+	if gen.trusted(src) != noContext {
+		return fmt.Sprintf("htmpl.Escape(%s, %s)", contextNames[ctx], name)
+	}
+	return fmt.Sprintf("htmpl.Escape(%s, %s)", contextNames[ctx], gen.stringValue(src))
+}
+
+// noContext is returned by trusted for values that are not of a trusted type
+const noContext htmpl.Context = 255
+
+// trustedTypes maps the names of the trusted types of htmpl and html/template to the contexts in which they are trusted
+var trustedTypes = map[string]htmpl.Context{
+	"HTML": htmpl.ContextText,
+	"URL":  htmpl.ContextURL,
+	"JS":   htmpl.ContextJS,
+	"CSS":  htmpl.ContextCSS,
+}
+
+// trusted returns the context in which the value of src is trusted, if it is a variable path with a trusted type such as htmpl.HTML.
+// The types of other expressions are not known before unwrapping, so they are never trusted.
+func (gen *generator) trusted(src string) htmpl.Context {
+	_, ty := gen.value(src)
+	named, ok := deref(ty).(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return noContext
+	}
+	switch named.Obj().Pkg().Path() {
+	case "github.com/vktec/htmpl", "html/template":
+		if ctx, ok := trustedTypes[named.Obj().Name()]; ok {
+			return ctx
+		}
+	}
+	return noContext
+}
+
 func (gen *generator) get(path string) (string, types.Type) {
+	x := gen.path(path)
+	return x.code, x.ty
+}
+
+// path generates an operand for a variable path, unwrapping its value
+func (gen *generator) path(path string) operand {
 	goName, ty, _ := gen.get_(path, false)
-	return goName, ty
+	return gen.unwrapOperand(goName, ty)
 }
+
+// value generates code for the value of an attribute that is bound to a variable.
+// If the attribute is a variable path, the value is not unwrapped, so the methods of its type remain available.
+func (gen *generator) value(src string) (string, types.Type) {
+	src = strings.TrimSpace(src)
+	if src == "" || strings.ContainsAny(src, " \t\r\n()=!<>\"'|") || isDigit(src[0]) || src[0] == '-' {
+		return gen.expr(src)
+	}
+	goName, ty, _ := gen.get_(src, false)
+	return goName, types.Unalias(ty)
+}
+
+// get_ generates code for a variable path, returning its code and type before unwrapping
 func (gen *generator) get_(path string, nested bool) (goName string, ty types.Type, rest string) {
 	if path == "" {
 		return "", nil, ""
@@ -299,13 +1356,29 @@ func (gen *generator) get_(path string, nested bool) (goName string, ty types.Ty
 	}
 	if head == "" {
 		head = "."
-		if path == "." {
-			path = ""
+		if path == "." || len(path) > 1 && path[0] == '.' && (path[1] == '[' || path[1] == ']') {
+			// The dot is the whole path, or is indexed or used as a key by a bracketed path
+			path = path[1:]
 		}
 	}
-	goName, ty = unwrap(gen.name(head), gen.ty(head))
+	goName, ty = gen.name(head), gen.ty(head)
+	addressable := true // Whether goName is addressable, so methods with pointer receivers can be called on it
+	var checks []string // Statements binding the pointers followed by the path, which return early if they are nil
 
 	for path != "" && ty != nil {
+		if gen.isLookuper(ty) {
+			gen.fail(fmt.Errorf("cannot index %s: htmpl.Lookuper is not supported in generated code", ty))
+			return "", nil, ""
+		}
+		code, uty := goName, ty.Underlying()
+		for p, ok := uty.(*types.Pointer); ok; p, ok = uty.(*types.Pointer) {
+			// The rest of the path is empty if the pointer is nil, as in the evaluator
+			ptr := fmt.Sprintf("p%d", len(checks))
+			checks = append(checks, fmt.Sprintf("%s := %s\nif %[1]s == nil {\nreturn\n}\n", ptr, code))
+			code, uty = "(*"+ptr+")", p.Elem().Underlying()
+			// Dereferenced pointers are addressable
+			addressable = true
+		}
 		sep := path[0]
 		path = path[1:]
 		switch sep {
@@ -317,16 +1390,33 @@ func (gen *generator) get_(path string, nested bool) (goName string, ty types.Ty
 			} else {
 				part, path = path[:idx], path[idx:]
 			}
-			goName, ty = index(goName, part, ty)
+			// As in the evaluator, methods are only called if the key cannot name a field, element or map key
+			name, ity := gen.index(code, part, uty)
+			if ity == nil {
+				if m, mty, ok := gen.method(code, ty, part, addressable); ok {
+					goName, ty, addressable = m, mty, false
+					break
+				}
+			}
+			goName, ty = name, ity
+			switch uty.(type) {
+			case *types.Map, *types.Slice:
+				// Slice elements are copied out of the bounds check
+				addressable = false
+			case *types.Struct:
+				addressable = addressable && !strings.HasSuffix(goName, "()")
+			}
 
 		case '[':
 			part, partTy, rest := gen.get_(path, true)
+			part, partTy = gen.unwrap(part, partTy)
 			path = rest
-			goName, ty = indexVal(goName, part, ty, partTy)
+			goName, ty = gen.indexVal(code, part, uty, partTy)
+			addressable = false
 
 		case ']':
 			if nested {
-				return goName, ty, path[1:]
+				return gen.guard(goName, ty, checks), ty, path
 			} else {
 				return "", nil, ""
 			}
@@ -340,18 +1430,38 @@ func (gen *generator) get_(path string, nested bool) (goName string, ty types.Ty
 		// Unmatched '['
 		return "", nil, ""
 	} else {
-		return goName, ty, ""
+		return gen.guard(goName, ty, checks), ty, ""
+	}
+}
+
+// guard generates code for the value of a path of type ty, which first runs the statements checking the pointers it follows
+func (gen *generator) guard(goName string, ty types.Type, checks []string) string {
+	if len(checks) == 0 || ty == nil {
+		return goName
 	}
+	return fmt.Sprintf("func() (v %s) {\n%sv = %s\nreturn\n}()", gen.typeString(ty), strings.Join(checks, ""), goName)
 }
 
+// name returns the Go identifier for a variable.
+// Characters of the variable's name that cannot appear in identifiers, and underscores, are replaced by an underscore and their hexadecimal code,
+// so each variable has a different identifier.
 func (gen *generator) name(varName string) (goName string) {
 	if varName == "." {
 		return "dot"
 	} else if varName == "$" {
 		return "dollar"
-	} else {
-		return "var_" + varName
 	}
+	b := strings.Builder{}
+	b.WriteString("var_")
+	for i := 0; i < len(varName); i++ {
+		c := varName[i]
+		if isDigit(c) || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
 }
 
 func (gen *generator) ty(name string) types.Type {
@@ -371,83 +1481,388 @@ func (gen *generator) popTy(name string) {
 }
 
 func getAttr(node *html.Node, key string) string {
+	val, _ := getAttrOk(node, key)
+	return val
+}
+func getAttrOk(node *html.Node, key string) (string, bool) {
 	for _, attr := range node.Attr {
 		if attr.Key == key {
-			return attr.Val
+			return attr.Val, true
 		}
 	}
-	return ""
+	return "", false
 }
 
-func index(goName, key string, ty types.Type) (string, types.Type) {
+// index indexes a value of an unwrapped type with a key, returning the code and type of the result before unwrapping
+func (gen *generator) index(goName, key string, ty types.Type) (string, types.Type) {
 	switch cty := ty.(type) {
 	case *types.Array:
 		i, err := strconv.ParseInt(key, 0, 0)
-		if err != nil || i > cty.Len() {
+		if err != nil || i < 0 || i >= cty.Len() {
 			return "", nil
 		}
 		goName += "[" + key + "]"
 		ty = cty.Elem()
 
 	case *types.Slice:
-		_, err := strconv.ParseInt(key, 0, 0)
-		if err != nil {
+		i, err := strconv.ParseInt(key, 0, 0)
+		if err != nil || i < 0 {
 			return "", nil
 		}
-		// TODO: don't panic
-		goName += "[" + key + "]"
+		// The length is not known until run time, so indices out of range produce the zero value
+		goName = fmt.Sprintf("func() (v %s) {\nif len(%s) > %s {\nv = %[2]s[%[3]s]\n}\nreturn\n}()", gen.typeString(cty.Elem()), goName, key)
 		ty = cty.Elem()
 
-	case *types.Basic, *types.Chan:
+	case *types.Basic, *types.Chan, *types.Signature:
 		return "", nil
 
 	case *types.Map:
-		goName += fmt.Sprintf("[%q]", key)
+		k, _ := cty.Key().Underlying().(*types.Basic)
+		switch {
+		case k != nil && k.Info()&types.IsString != 0:
+			goName += fmt.Sprintf("[%q]", key)
+		case k != nil && k.Info()&types.IsInteger != 0:
+			// Keys that are not integers can never be present
+			if _, err := strconv.ParseInt(key, 10, 64); err != nil {
+				return "", nil
+			}
+			goName += "[" + key + "]"
+		default:
+			return "", nil
+		}
 		ty = cty.Elem()
 
 	case *types.Struct:
-		f := fieldByName(cty, key)
-		if f == nil {
+		goName, ty = gen.field(goName, cty, key)
+		if ty == nil {
 			return "", nil
 		}
-		goName += "." + key
-		ty = f.Type()
+
+	case *types.Interface:
+		gen.fail(fmt.Errorf("cannot index %s: values of interface types are not supported in generated code", ty))
+		return "", nil
 
 	default:
-		panic("Unknown type " + cty.String())
+		gen.fail(fmt.Errorf("cannot index %s", ty))
+		return "", nil
 	}
 
-	return unwrap(goName, ty)
+	return goName, ty
 }
 
-func indexVal(goName, keyName string, ty, keyTy types.Type) (string, types.Type) {
-	panic("TODO")
+// indexVal indexes a value of an unwrapped type with the value of a bracketed path, which has type keyTy.
+// The code and type of the result are returned before unwrapping.
+// Key types that can never index the value are recorded as errors.
+// Where the evaluator would produce an empty, the generated code produces the zero value of the element type.
+func (gen *generator) indexVal(goName, keyName string, ty, keyTy types.Type) (string, types.Type) {
+	if keyTy == nil {
+		return "", nil
+	}
+	var isInt, isString bool
+	if b, ok := keyTy.(*types.Basic); ok {
+		isInt = b.Info()&types.IsInteger != 0
+		isString = b.Info()&types.IsString != 0
+	}
+
+	var elemTy types.Type
+	switch cty := ty.(type) {
+	case *types.Array, *types.Slice:
+		if a, ok := cty.(*types.Array); ok {
+			elemTy = a.Elem()
+		} else {
+			elemTy = cty.(*types.Slice).Elem()
+		}
+		var i string
+		switch {
+		case isInt:
+			i = fmt.Sprintf("int(%s)", keyName)
+		case isString:
+			i = fmt.Sprintf("gen.ParseIndex(string(%s))", keyName)
+		default:
+			gen.fail(fmt.Errorf("cannot index %s with %s", ty, keyTy))
+			return "", nil
+		}
+		goName = fmt.Sprintf("func() (v %s) {\nif i := %s; i >= 0 && i < len(%s) {\nv = %[3]s[i]\n}\nreturn\n}()", gen.typeString(elemTy), i, goName)
+
+	case *types.Map:
+		elemTy = cty.Elem()
+		k, _ := cty.Key().Underlying().(*types.Basic)
+		switch {
+		case k != nil && k.Info()&types.IsString != 0 && isString:
+			goName = fmt.Sprintf("%s[%s(%s)]", goName, gen.typeString(cty.Key()), keyName)
+		case k != nil && k.Info()&types.IsString != 0 && isInt:
+			goName = fmt.Sprintf("%s[%s(fmt.Sprint(%s))]", goName, gen.typeString(cty.Key()), keyName)
+		case k != nil && k.Info()&types.IsInteger != 0 && isInt:
+			goName = fmt.Sprintf("%s[%s(%s)]", goName, gen.typeString(cty.Key()), keyName)
+		default:
+			gen.fail(fmt.Errorf("cannot index %s with %s", ty, keyTy))
+			return "", nil
+		}
+
+	case *types.Struct:
+		if !isString {
+			gen.fail(fmt.Errorf("cannot index %s with %s", ty, keyTy))
+			return "", nil
+		}
+		// Generate a switch over the field names, which requires all fields to have the same type
+		b := strings.Builder{}
+		for _, f := range gen.fields(cty) {
+			code, fty := gen.fieldByIndex(goName, cty, f)
+			if elemTy == nil {
+				elemTy = fty
+			} else if !types.Identical(elemTy, fty) {
+				gen.fail(fmt.Errorf("cannot index %s with %s: fields have different types", ty, keyTy))
+				return "", nil
+			}
+			fmt.Fprintf(&b, "case %q:\nv = %s\n", f.name, code)
+		}
+		if elemTy == nil {
+			return "", nil
+		}
+		goName = fmt.Sprintf("func() (v %s) {\nswitch string(%s) {\n%s}\nreturn\n}()", gen.typeString(elemTy), keyName, b.String())
+
+	case *types.Basic, *types.Chan, *types.Signature:
+		return "", nil
+
+	case *types.Interface:
+		gen.fail(fmt.Errorf("cannot index %s: values of interface types are not supported in generated code", ty))
+		return "", nil
+
+	default:
+		gen.fail(fmt.Errorf("cannot index %s", ty))
+		return "", nil
+	}
+	return goName, elemTy
+}
+
+// typeString returns the name of a type, as used in the generated code
+func (gen *generator) typeString(ty types.Type) string {
+	return types.TypeString(ty, gen.qualifier)
+}
+
+// unwrap follows the pointers in a value of type ty, returning the code and underlying type of the value they point to.
+// If any of the pointers are nil, the generated code produces the zero value of that type, as the evaluator produces an empty.
+func (gen *generator) unwrap(goName string, ty types.Type) (string, types.Type) {
+	x := gen.unwrapOperand(goName, ty)
+	return x.code, x.ty
 }
 
-func unwrap(goName string, ty types.Type) (string, types.Type) {
+// unwrapOperand is like unwrap, but returns an operand, which also records the code for the last pointer that was followed
+func (gen *generator) unwrapOperand(goName string, ty types.Type) operand {
 	if ty == nil {
-		return goName, ty
+		return operand{code: goName}
 	}
-	ty = ty.Underlying()
-	pty, ok := ty.(*types.Pointer)
-	if !ok {
-		return goName, ty
+	var elems []types.Type // The type pointed to by each pointer
+	for p, ok := ty.Underlying().(*types.Pointer); ok; p, ok = p.Elem().Underlying().(*types.Pointer) {
+		elems = append(elems, p.Elem())
 	}
-	for ok {
-		goName = "*" + goName
-		ty = pty.Elem().Underlying()
-		pty, ok = ty.(*types.Pointer)
+	switch n := len(elems); n {
+	case 0:
+		return operand{code: goName, ty: ty.Underlying()}
+	case 1:
+		return operand{code: gen.follow(goName, elems), ty: elems[0].Underlying(), addr: goName}
+	default:
+		return operand{code: gen.follow(goName, elems), ty: elems[n-1].Underlying(), addr: gen.follow(goName, elems[:n-1])}
+	}
+}
+
+// follow generates code following pointers from goName, where elems are the types they point to.
+// If any of the pointers are nil, the code produces the zero value of the last type.
+func (gen *generator) follow(goName string, elems []types.Type) string {
+	checks := make([]string, len(elems))
+	for i := range elems {
+		checks[i] = strings.Repeat("*", i) + "p != nil"
 	}
-	return "(" + goName + ")", ty
+	return fmt.Sprintf("func() (v %s) {\nif p := %s; %s {\nv = %sp\n}\nreturn\n}()",
+		gen.typeString(elems[len(elems)-1]), goName, strings.Join(checks, " && "), strings.Repeat("*", len(elems)))
 }
 
-func fieldByName(s *types.Struct, name string) *types.Var {
-	// TODO: support embedding
-	for i := 0; i < s.NumFields(); i++ {
-		f := s.Field(i)
-		if f.Name() == name {
-			return f
+// field generates an access to a field of a struct, following Go's rules for promoted fields.
+// As in the evaluator, only the fields returned by fields can be accessed, and if Config.StructTags is set, they are named by their struct tags.
+// The code and type of the field are returned before unwrapping.
+func (gen *generator) field(goName string, s *types.Struct, name string) (string, types.Type) {
+	for _, f := range gen.fields(s) {
+		if f.name == name {
+			return gen.fieldByIndex(goName, s, f)
 		}
 	}
-	return nil
+	return "", nil
+}
+
+// fieldByIndex generates an access to a field of a struct by its index sequence.
+// Fields promoted through a nil embedded pointer have the zero value of their type, as the evaluator produces an empty.
+func (gen *generator) fieldByIndex(goName string, s *types.Struct, f structField) (string, types.Type) {
+	code := goName
+	var checks []string
+	var t types.Type = s
+	for _, i := range f.index {
+		u := t.Underlying()
+		if p, ok := u.(*types.Pointer); ok {
+			checks = append(checks, code+" != nil")
+			u = p.Elem().Underlying()
+		}
+		sf := u.(*types.Struct).Field(i)
+		if !sf.Exported() && sf.Pkg() != gen.pkg {
+			// The path to the field is inaccessible, so rely on the promoted selector
+			code, checks = goName+"."+f.v.Name(), nil
+			break
+		}
+		code += "." + sf.Name()
+		t = sf.Type()
+	}
+	if len(checks) > 0 {
+		code = fmt.Sprintf("func() (v %s) {\nif %s {\nv = %s\n}\nreturn\n}()", gen.typeString(f.v.Type()), strings.Join(checks, " && "), code)
+	}
+	return code, f.v.Type()
+}
+
+// method generates a call to the exported method of a value with the given name, and reports whether it exists.
+// ty is the type of the value before unwrapping, and goName is its unwrapped code.
+// As in the evaluator, methods are looked up in the method set of the pointer type, and only methods that take no arguments,
+// and return one value or a value and an error, are considered.
+func (gen *generator) method(goName string, ty types.Type, name string, addressable bool) (string, types.Type, bool) {
+	if !token.IsExported(name) {
+		return "", nil, false
+	}
+	for {
+		p, ok := ty.Underlying().(*types.Pointer)
+		if !ok {
+			break
+		}
+		ty = p.Elem()
+	}
+	sel := types.NewMethodSet(types.NewPointer(ty)).Lookup(gen.pkg, name)
+	if sel == nil {
+		return "", nil, false
+	}
+	sig := sel.Type().(*types.Signature)
+	results := sig.Results()
+	if sig.Params().Len() != 0 || results.Len() < 1 || results.Len() > 2 || results.Len() == 2 && !types.Identical(results.At(1).Type(), types.Universe.Lookup("error").Type()) {
+		return "", nil, false
+	}
+
+	code := fmt.Sprintf("%s.%s()", goName, name)
+	if _, ptr := sel.Obj().Type().(*types.Signature).Recv().Type().(*types.Pointer); ptr && !addressable {
+		// Call the method on a copy, as the evaluator does
+		code = fmt.Sprintf("func(v %s) %s {\nreturn v.%s()\n}(%s)", gen.typeString(ty), gen.typeString(results), name, goName)
+	}
+	if results.Len() == 2 {
+		code = fmt.Sprintf("gen.Result(%s)", code)
+	}
+	return code, results.At(0).Type(), true
+}
+
+// isLookuper reports whether a type implements htmpl.Lookuper, or would after dereferencing or taking its address.
+// The values returned by Lookup are not statically typed, so the generated code cannot index them.
+func (gen *generator) isLookuper(ty types.Type) bool {
+	for {
+		p, ok := ty.Underlying().(*types.Pointer)
+		if !ok {
+			break
+		}
+		ty = p.Elem()
+	}
+	sel := types.NewMethodSet(types.NewPointer(ty)).Lookup(nil, "Lookup")
+	if sel == nil {
+		return false
+	}
+	sig := sel.Type().(*types.Signature)
+	if sig.Params().Len() != 1 || sig.Results().Len() != 2 || !types.Identical(sig.Params().At(0).Type(), types.Typ[types.String]) {
+		return false
+	}
+	iface, ok := sig.Results().At(0).Type().Underlying().(*types.Interface)
+	return ok && iface.Empty() && types.Identical(sig.Results().At(1).Type(), types.Typ[types.Bool])
+}
+
+// A structField is a field of a struct that can be accessed by name
+type structField struct {
+	name  string // The name of the field, which is given by its struct tag if Config.StructTags is set
+	v     *types.Var
+	index []int // The index sequence of the field, as returned by types.LookupFieldOrMethod
+}
+
+// fields returns the exported fields of a struct that can be accessed by name, in the same order as the evaluator.
+// The fields of embedded structs are promoted following Go's rules, and replace the embedded field itself.
+// If Config.StructTags is set, fields are renamed or hidden by their struct tags, and embedded structs with a name in their tag are not promoted.
+func (gen *generator) fields(s *types.Struct) []structField {
+	type candidate struct {
+		structField
+		depth    int
+		embedded bool // Embedded structs take part in name resolution, but are replaced by their fields
+		tagged   bool // Whether the field was named by a struct tag
+	}
+	var all []candidate
+	seen := map[types.Type]bool{s: true}
+	var walk func(s *types.Struct, index []int)
+	walk = func(s *types.Struct, index []int) {
+		for i := 0; i < s.NumFields(); i++ {
+			f := structField{s.Field(i).Name(), s.Field(i), append(index[:len(index):len(index)], i)}
+			ft := f.v.Type().Underlying()
+			if p, ok := ft.(*types.Pointer); ok {
+				ft = p.Elem().Underlying()
+			}
+			fs, embedded := ft.(*types.Struct)
+			embedded = embedded && f.v.Embedded()
+			tagged := false
+			if gen.config.StructTags {
+				name, hidden := tagName(reflect.StructTag(s.Tag(i)))
+				if hidden {
+					continue
+				}
+				if name != "" {
+					f.name, embedded, tagged = name, false, true
+				}
+			}
+			all = append(all, candidate{f, len(index), embedded, tagged})
+			if embedded && !seen[fs] {
+				seen[fs] = true
+				walk(fs, f.index)
+				delete(seen, fs)
+			}
+		}
+	}
+	walk(s, nil)
+
+	// A name refers to the shallowest field with that name, if there is exactly one.
+	// A single field named by a tag takes precedence over others at the same depth.
+	best := make(map[string][]int) // The indices in all of the shallowest fields with each name
+	for i, c := range all {
+		if b := best[c.name]; len(b) == 0 || c.depth < all[b[0]].depth {
+			best[c.name] = []int{i}
+		} else if c.depth == all[b[0]].depth {
+			best[c.name] = append(b, i)
+		}
+	}
+	var fs []structField
+	for i, c := range all {
+		if c.embedded || !c.v.Exported() {
+			continue
+		}
+		b := best[c.name]
+		if len(b) > 1 {
+			var tagged []int
+			for _, j := range b {
+				if all[j].tagged {
+					tagged = append(tagged, j)
+				}
+			}
+			b = tagged
+		}
+		if len(b) == 1 && b[0] == i {
+			fs = append(fs, c.structField)
+		}
+	}
+	return fs
+}
+
+// tagName returns the name of a field given by its htmpl struct tag, or its json struct tag if it has no htmpl tag.
+// The field is hidden if the tag is "-".
+func tagName(tag reflect.StructTag) (name string, hidden bool) {
+	for _, key := range []string{"htmpl", "json"} {
+		if val, ok := tag.Lookup(key); ok {
+			name, _, _ = strings.Cut(val, ",")
+			return name, name == "-" && val == "-"
+		}
+	}
+	return "", false
 }
@@ -0,0 +1,354 @@
+package gen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+	"testing/fstest"
+
+	"github.com/vktec/htmlparse"
+	"github.com/vktec/htmpl"
+	"golang.org/x/net/html"
+)
+
+// stubs declares the parts of other packages used by the types in tests
+var stubs = stubImporter{
+	"golang.org/x/net/html":  `package html; type Node struct{ Data string }`,
+	"github.com/vktec/htmpl": `package htmpl; type HTML string`,
+}
+
+// A stubImporter imports packages from their stub source code, keyed by path
+type stubImporter map[string]string
+
+func (imp stubImporter) Import(path string) (*types.Package, error) {
+	src, ok := imp[path]
+	if !ok {
+		return nil, fmt.Errorf("no stub for package %q", path)
+	}
+	return check(path, src, imp)
+}
+
+// check type-checks the source code of a package
+func check(path, src string, imp types.Importer) (*types.Package, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path+".go", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	return (&types.Config{Importer: imp}).Check(path, fset, []*ast.File{f}, nil)
+}
+
+// newTestGenerator returns a generator for a dot of the type named dot, which is declared in src along with any other types
+func newTestGenerator(t *testing.T, src string) *generator {
+	t.Helper()
+	pkg, err := check("p", "package p\n"+src, stubs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newGenerator(&Config{}, pkg, pkg.Scope().Lookup("dot").Type())
+}
+
+// Bracketed paths may index dot and $ directly, and use dot as a key
+func TestBracketedDot(t *testing.T) {
+	gen := newTestGenerator(t, `type dot map[string]int`)
+	gen.pushTy("k", types.Typ[types.String])
+	tests := []struct{ src, code string }{
+		{".[k]", "dot[string(var_k)]"},
+		{"$[k]", "dollar[string(var_k)]"},
+		{"$[.]", "dollar[string(dot)]"},
+	}
+	for i, test := range tests {
+		if i == 2 {
+			gen.pushTy(".", types.Typ[types.String])
+		}
+		code, ty := gen.expr(test.src)
+		if code != test.code || ty != types.Typ[types.Int] || gen.err != nil {
+			t.Errorf("%s: expected %s of type int, received %s of type %v (error: %v)", test.src, test.code, code, ty, gen.err)
+		}
+	}
+}
+
+// Nil pointers are falsey in conditions, so must not be dereferenced
+func TestTruthyPointer(t *testing.T) {
+	gen := newTestGenerator(t, `type dot struct{ P *int; PP **string; N int }; func (dot) Get() *int { return nil }`)
+	tests := []struct{ src, code string }{
+		// The method is only called once
+		{".Get", "func() bool {\np := dot.Get()\nreturn p != nil && (*p) != 0\n}()"},
+		{".P", "func() bool {\np := dot.P\nreturn p != nil && (*p) != 0\n}()"},
+		{".PP", "func() bool {\np := dot.PP\nreturn p != nil && *p != nil && (**p) != \"\"\n}()"},
+		{".N", "dot.N != 0"},
+	}
+	for _, test := range tests {
+		gen.Reset()
+		gen.genTruthy(test.src)
+		if code := gen.String(); code != test.code {
+			t.Errorf("%s: expected %s, received %s", test.src, test.code, code)
+		}
+	}
+}
+
+// Fields and map keys take precedence over methods with the same name, as in the evaluator
+func TestMethodPrecedence(t *testing.T) {
+	gen := newTestGenerator(t, `type counts map[string]int
+func (counts) Total() int { return 0 }
+type ids map[int]string
+func (ids) Total() int { return 0 }
+type meta struct{ Name string }
+type named struct{ meta }
+func (named) Name() string { return "" }
+type dot struct{ C counts; I ids; N named }`)
+	tests := []struct{ src, code string }{
+		{".C.Total", `dot.C["Total"]`},
+		{".I.Total", "dot.I.Total()"},
+		{".N.Name", "dot.N.meta.Name"},
+	}
+	for _, test := range tests {
+		if code, _ := gen.expr(test.src); code != test.code || gen.err != nil {
+			t.Errorf("%s: expected %q, received %q (error: %v)", test.src, test.code, code, gen.err)
+		}
+	}
+}
+
+// Values of interface types are tested and converted to strings at run time
+func TestInterface(t *testing.T) {
+	gen := newTestGenerator(t, `type dot map[string]interface{}`)
+	code, ty := gen.expr(".x")
+	if truthy := truthy(code, ty); truthy != `htmpl.Truthy(dot["x"])` {
+		t.Errorf("Expected htmpl.Truthy(dot[\"x\"]), received %s", truthy)
+	}
+	if stringify := stringify(code, ty); stringify != `gen.Stringify(dot["x"])` {
+		t.Errorf("Expected gen.Stringify(dot[\"x\"]), received %s", stringify)
+	}
+}
+
+// Nodes are rendered as HTML when converted to strings
+func TestStringifyNode(t *testing.T) {
+	gen := newTestGenerator(t, `import "golang.org/x/net/html"
+type dot struct {
+	N  html.Node
+	NS []*html.Node
+	P  *html.Node
+	S  string
+}`)
+	tests := []struct{ src, code string }{
+		{".N", "gen.Stringify(dot.N)"},
+		{".NS", "gen.Stringify(dot.NS)"},
+		{".P", "gen.Stringify(dot.P)"},
+		{".S", "string(dot.S)"},
+	}
+	for _, test := range tests {
+		gen.Reset()
+		gen.genStringify(test.src)
+		if code := gen.String(); code != test.code {
+			t.Errorf("%s: expected %s, received %s", test.src, test.code, code)
+		}
+	}
+}
+
+// Aliases are resolved, so aliases of node and trusted types are recognised
+func TestAlias(t *testing.T) {
+	gen := newTestGenerator(t, `import (
+	"github.com/vktec/htmpl"
+	"golang.org/x/net/html"
+)
+type node = html.Node
+type nodes = []*node
+type trusted = htmpl.HTML
+type dot = struct {
+	N  *node
+	NS nodes
+	H  *trusted
+}`)
+	tests := []struct{ src, code string }{
+		{".N", "gen.Stringify(dot.N)"},
+		{".NS", "gen.Stringify(dot.NS)"},
+	}
+	for _, test := range tests {
+		gen.Reset()
+		gen.genStringify(test.src)
+		if code := gen.String(); code != test.code {
+			t.Errorf("%s: expected %s, received %s", test.src, test.code, code)
+		}
+	}
+	if ctx := gen.trusted(".H"); ctx != htmpl.ContextText {
+		t.Errorf(".H: expected context %d, received %d", htmpl.ContextText, ctx)
+	}
+}
+
+// Indices outside the bounds of an array are empty
+func TestArrayIndex(t *testing.T) {
+	gen := newTestGenerator(t, `type dot [3]int`)
+	tests := []struct{ src, code string }{
+		{".0", "dot[0]"},
+		{".2", "dot[2]"},
+		{".3", ""},
+		{".-1", ""},
+	}
+	for _, test := range tests {
+		code, ty := gen.expr(test.src)
+		if code != test.code || (ty == nil) != (test.code == "") {
+			t.Errorf("%s: expected %q, received %q of type %v", test.src, test.code, code, ty)
+		}
+	}
+}
+
+// Variables are given distinct, valid Go identifiers
+func TestName(t *testing.T) {
+	gen := newTestGenerator(t, `type dot int`)
+	tests := []struct{ name, goName string }{
+		{".", "dot"},
+		{"$", "dollar"},
+		{"loop", "var_loop"},
+		{"data-x", "var_data_2dx"},
+		{"data_x", "var_data_5fx"},
+		{"é", "var__c3_a9"},
+	}
+	for _, test := range tests {
+		if goName := gen.name(test.name); goName != test.goName || !token.IsIdentifier(goName) {
+			t.Errorf("%s: expected %s, received %s", test.name, test.goName, goName)
+		}
+	}
+}
+
+// Arrays may be joined and sliced, as slices are
+func TestArrayBuiltins(t *testing.T) {
+	gen := newTestGenerator(t, `type dot map[string][3]int`)
+	tests := []struct{ src, code string }{
+		{".a | join '-'", "gen.Join(func(a [3]int) []int {\nreturn a[:]\n}(dot[\"a\"]), string(\"-\"))"},
+		{".a | slice 1", "gen.Slice(func(a [3]int) []int {\nreturn a[:]\n}(dot[\"a\"]), int(1))"},
+	}
+	for _, test := range tests {
+		if code, _ := gen.expr(test.src); code != test.code || gen.err != nil {
+			t.Errorf("%s: expected %q, received %q (error: %v)", test.src, test.code, code, gen.err)
+		}
+	}
+}
+
+// Defaults must be assignable to the type of the value they replace
+func TestDefault(t *testing.T) {
+	tests := []struct{ src, code, err string }{
+		{".S | default 'x'", "gen.Default((string)(dot.S), (string)(\"x\"))", ""},
+		{".N | default 5", "gen.Default((int)(dot.N), (int)(5))", ""},
+		{".F | default 5", "gen.Default((float64)(dot.F), (float64)(5))", ""},
+		{".U | default 5", "gen.Default((uint)(dot.U), (uint)(5))", ""},
+		{".N | default .M", "gen.Default((int)(dot.N), (int)(dot.M))", ""},
+		{".N | default 2.5", "", `argument 2 to "default": cannot use float64 as int`},
+		{".U | default -1", "", `argument 2 to "default": cannot use int as uint`},
+		{".N | default 'x'", "", `argument 2 to "default": cannot use string as int`},
+		{".N | default .S", "", `argument 2 to "default": cannot use string as int`},
+		{".N | default .I", "", `argument 2 to "default": cannot use int64 as int`},
+	}
+	for _, test := range tests {
+		gen := newTestGenerator(t, `type number int; type dot struct{ S string; N, M number; F float64; U uint; I int64 }`)
+		code, _ := gen.expr(test.src)
+		err := ""
+		if gen.err != nil {
+			err = gen.err.Error()
+		}
+		if code != test.code || err != test.err {
+			t.Errorf("%s: expected %q (error %q), received %q (error %q)", test.src, test.code, test.err, code, err)
+		}
+	}
+}
+
+// Indices outside the bounds of a slice are empty when the code is run
+func TestSliceIndex(t *testing.T) {
+	gen := newTestGenerator(t, `type dot []int`)
+	tests := []struct{ src, code string }{
+		{".0", "func() (v int) {\nif len(dot) > 0 {\nv = dot[0]\n}\nreturn\n}()"},
+		{".3", "func() (v int) {\nif len(dot) > 3 {\nv = dot[3]\n}\nreturn\n}()"},
+		{".-1", ""},
+	}
+	for _, test := range tests {
+		code, ty := gen.expr(test.src)
+		if code != test.code || (ty == nil) != (test.code == "") {
+			t.Errorf("%s: expected %q, received %q of type %v", test.src, test.code, code, ty)
+		}
+	}
+}
+
+// Only the fields the evaluator can access are accessible
+func TestField(t *testing.T) {
+	gen := newTestGenerator(t, `type meta struct{ Name, Note string }; type dot struct{ meta; ID int; Name string; hidden string }`)
+	tests := []struct{ src, code string }{
+		{".ID", "dot.ID"},
+		{".Name", "dot.Name"},
+		{".Note", "dot.meta.Note"},
+		{".hidden", ""},
+		{".meta", ""},
+		{".meta.Note", ""},
+	}
+	for _, test := range tests {
+		code, ty := gen.expr(test.src)
+		if code != test.code || (ty == nil) != (test.code == "") {
+			t.Errorf("%s: expected %q, received %q of type %v", test.src, test.code, code, ty)
+		}
+	}
+}
+
+// Constant bounds of ranges must be integers, as they must be when evaluated
+func TestRangeBounds(t *testing.T) {
+	tests := []struct{ src, err string }{
+		{`<for from="0" to="2.5"></for>`, `<for> attribute "to": 2.5 is not an integer`},
+		{`<for to="-1e300"></for>`, `<for> attribute "to": -1e+300 is out of range`},
+		{`<for to="3.0" step="0.0"></for>`, `<for> attribute "step": step must not be zero`},
+		{`<for to="3" step="0"></for>`, `<for> attribute "step": step must not be zero`},
+		{`<for to="3.0"></for>`, ""},
+	}
+	for _, test := range tests {
+		gen := newTestGenerator(t, `type dot struct{}`)
+		node := &html.Node{}
+		if err := htmlparse.Parse(node, []byte(test.src)); err != nil {
+			t.Fatal(err)
+		}
+		err := ""
+		if e := gen.genRange(node.FirstChild); e != nil {
+			err = e.Error()
+		}
+		if err != test.err {
+			t.Errorf("%s: expected error %q, received %q", test.src, test.err, err)
+		}
+	}
+}
+
+// Paths following nil pointers are empty, so the pointers are checked before they are dereferenced
+func TestNilPointer(t *testing.T) {
+	gen := newTestGenerator(t, `type user struct{ Name string }; type dot struct{ User *user; P *int; PP **int }`)
+	tests := []struct{ src, code string }{
+		{".User.Name", "func() (v string) {\np0 := dot.User\nif p0 == nil {\nreturn\n}\nv = (*p0).Name\nreturn\n}()"},
+		{".P", "func() (v int) {\nif p := dot.P; p != nil {\nv = *p\n}\nreturn\n}()"},
+		{".PP", "func() (v int) {\nif p := dot.PP; p != nil && *p != nil {\nv = **p\n}\nreturn\n}()"},
+	}
+	for _, test := range tests {
+		if code, _ := gen.expr(test.src); code != test.code || gen.err != nil {
+			t.Errorf("%s: expected %q, received %q (error: %v)", test.src, test.code, code, gen.err)
+		}
+	}
+}
+
+// Values whose types are not known statically cannot be indexed or iterated over, which is reported with the position of the element
+func TestUnsupportedType(t *testing.T) {
+	tests := []struct{ src, err string }{
+		{"<p>\n  <v>.A.b</v></p>", "t.html:2:3: <v>: cannot index interface{}: values of interface types are not supported in generated code"},
+		{"<p>\n  <for v=\".A\">x</for></p>", "t.html:2:3: <for>: cannot iterate over interface{}: values of interface types are not supported in generated code"},
+		{`<v>.A</v><if v=".A">x</if><if v=".F">x</if><for v=".F">x</for><v>.F.x</v>`, ""},
+	}
+	for _, test := range tests {
+		gen := newTestGenerator(t, `type dot struct{ A interface{}; F func() }`)
+		gen.config.FS = fstest.MapFS{"t.html": {Data: []byte(test.src)}}
+		node, err := gen.load("t.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := gen.genCode(node); err != nil {
+			gen.fail(err)
+		}
+		err = gen.err
+		if err == nil && test.err != "" || err != nil && err.Error() != test.err {
+			t.Errorf("%q: expected error %q, received %v", test.src, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package gen
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vktec/htmlparse"
+	"github.com/vktec/htmpl"
+	"github.com/vktec/htmpl/internal/builtin"
+	"golang.org/x/net/html"
+)
+
+// Result returns v, or the zero value of its type if err is not nil.
+// Generated code uses it to call functions that return errors, which are ignored as they are by htmpl.Evaluate.
+func Result[T any](v T, err error) T {
+	if err != nil {
+		var zero T
+		return zero
+	}
+	return v
+}
+
+// Loop describes the current iteration of a <for> element, and is the value of the loop variable within it.
+type Loop[K, V any] struct {
+	Index  int  // The index of the item, starting from 0
+	Number int  // The index of the item, starting from 1
+	Length int  // The number of items, or 0 if unknown
+	First  bool // Whether the item is the first
+	Last   bool // Whether the item is the last, if the length is known
+	Key    K    // The key of the item: its index in an array, or its key in a map
+	Value  V    // The item itself
+}
+
+// NewLoop returns the Loop for item i of a collection containing length items, or 0 if the length is unknown.
+func NewLoop[K, V any](i, length int, key K, value V) Loop[K, V] {
+	return Loop[K, V]{
+		Index:  i,
+		Number: i + 1,
+		Length: length,
+		First:  i == 0,
+		Last:   i == length-1,
+		Key:    key,
+		Value:  value,
+	}
+}
+
+// ParseIndex parses the index of an array from a string, as used by bracketed paths.
+// If the string is not a non-negative integer, it returns -1.
+func ParseIndex(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return -1
+	}
+	return i
+}
+
+// SortedKeys returns the keys of a map in their natural order, as used by sorted <for> elements.
+func SortedKeys[K comparable, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return htmpl.CompareKeys(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+// Stringify converts a value to a string as htmpl.Evaluate does, for values whose types are not known when the code is generated.
+// Pointers are followed, nodes are rendered as HTML, and nil is converted to an empty string.
+func Stringify(v interface{}) string {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return ""
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return ""
+	}
+	return htmpl.Escape(htmpl.ContextText, rv.Interface())
+}
+
+// ParseHTML parses a string of HTML into nodes, as used by <v noescape> elements and to substitute trusted HTML.
+// If policy is not nil, the nodes are sanitized by it.
+func ParseHTML(s string, policy *htmpl.Policy) []*html.Node {
+	p := html.Node{}
+	htmlparse.Parse(&p, []byte(s))
+	if policy != nil {
+		policy.Sanitize(&p)
+	}
+	var nodes []*html.Node
+	for child := p.FirstChild; child != nil; {
+		next := child.NextSibling
+		p.RemoveChild(child)
+		nodes = append(nodes, child)
+		child = next
+	}
+	return nodes
+}
+
+// CloneNode returns a deep copy of n, as substituted by <v noescape> elements.
+func CloneNode(n html.Node) *html.Node {
+	return cloneNode(&n)
+}
+
+// CloneNodes returns deep copies of nodes, as substituted by <v noescape> elements.
+func CloneNodes(nodes []*html.Node) []*html.Node {
+	ret := make([]*html.Node, len(nodes))
+	for i, n := range nodes {
+		ret[i] = cloneNode(n)
+	}
+	return ret
+}
+
+func cloneNode(n *html.Node) *html.Node {
+	clone := &html.Node{
+		Type:      n.Type,
+		DataAtom:  n.DataAtom,
+		Data:      n.Data,
+		Namespace: n.Namespace,
+		Attr:      append([]html.Attribute(nil), n.Attr...),
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		clone.AppendChild(cloneNode(child))
+	}
+	return clone
+}
+
+// RangeLength returns the number of integers from from to to inclusive, counting in steps of step.
+// If step is zero, the range is empty.
+func RangeLength(from, to, step int) int {
+	return builtin.RangeLength(from, to, step)
+}
+
+// The functions below implement the built-in functions for generated code.
+// Where the evaluator would produce an empty, they return the zero value of the result type.
+
+// Upper implements the upper function.
+func Upper(s string) string {
+	return strings.ToUpper(s)
+}
+
+// Lower implements the lower function.
+func Lower(s string) string {
+	return strings.ToLower(s)
+}
+
+// Title implements the title function.
+func Title(s string) string {
+	return builtin.Title(s)
+}
+
+// Trim implements the trim function.
+func Trim(s string) string {
+	return strings.TrimSpace(s)
+}
+
+// Truncate implements the truncate function.
+func Truncate(s string, n int) string {
+	return builtin.Truncate(s, n)
+}
+
+// Join implements the join function, converting the elements to strings as Stringify does.
+func Join[T any](s []T, sep string) string {
+	parts := make([]string, len(s))
+	for i, v := range s {
+		parts[i] = Stringify(v)
+	}
+	return strings.Join(parts, sep)
+}
+
+// Default implements the default function, returning def if v is falsey.
+func Default[T any](v, def T) T {
+	if htmpl.Truthy(v) {
+		return v
+	}
+	return def
+}
+
+// Len implements the len function for strings, counting characters rather than bytes.
+func Len(s string) int {
+	return utf8.RuneCountInString(s)
+}
+
+// First implements the first function for slices.
+func First[T any](s []T) T {
+	if len(s) == 0 {
+		var zero T
+		return zero
+	}
+	return s[0]
+}
+
+// Last implements the last function for slices.
+func Last[T any](s []T) T {
+	if len(s) == 0 {
+		var zero T
+		return zero
+	}
+	return s[len(s)-1]
+}
+
+// Slice implements the slice function for slices, clamping the indices to the bounds of s.
+func Slice[T any](s []T, i int, j ...int) []T {
+	start, end := builtin.SliceBounds(len(s), i, j...)
+	return s[start:end]
+}
+
+// Substr implements the slice function for strings, indexing by character.
+func Substr(s string, i int, j ...int) string {
+	r := []rune(s)
+	start, end := builtin.SliceBounds(len(r), i, j...)
+	return string(r[start:end])
+}
+
+// URLQuery implements the urlquery function.
+func URLQuery(s string) string {
+	return url.QueryEscape(s)
+}
+
+// JSON implements the json function.
+func JSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Pluralize implements the pluralize function.
+func Pluralize(n float64, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
+
+// Printf implements the printf function, formatting v and any other arguments.
+func Printf(v interface{}, format string, args ...interface{}) string {
+	return fmt.Sprintf(format, append([]interface{}{v}, args...)...)
+}
@@ -0,0 +1,91 @@
+package gen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vktec/htmpl"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func render(nodes []*html.Node) string {
+	b := strings.Builder{}
+	for _, node := range nodes {
+		html.Render(&b, node)
+	}
+	return b.String()
+}
+
+// The helpers used by generated code for <v noescape> should produce the same output as htmpl
+func TestNoescapeParity(t *testing.T) {
+	node := &html.Node{Type: html.ElementNode, DataAtom: atom.P, Data: "p"}
+	node.AppendChild(&html.Node{Type: html.TextNode, Data: "text"})
+	untrusted := `<b onclick="x()">bold</b><script>alert(1)</script><!-- comment --><a href="javascript:x()">link</a>`
+
+	tests := []struct {
+		dot       interface{}
+		generated func(policy *htmpl.Policy) []*html.Node
+	}{
+		{untrusted, func(policy *htmpl.Policy) []*html.Node { return ParseHTML(untrusted, policy) }},
+		{"plain & <i>simple</i>", func(policy *htmpl.Policy) []*html.Node { return ParseHTML("plain & <i>simple</i>", policy) }},
+		{htmpl.HTML(untrusted), func(*htmpl.Policy) []*html.Node { return ParseHTML(untrusted, nil) }},
+		{*node, func(*htmpl.Policy) []*html.Node { return []*html.Node{CloneNode(*node)} }},
+		{[]*html.Node{node, node}, func(*htmpl.Policy) []*html.Node { return CloneNodes([]*html.Node{node, node}) }},
+	}
+	for _, policy := range []*htmpl.Policy{nil, htmpl.DefaultPolicy()} {
+		tmpl, err := (&htmpl.Config{Policy: policy}).Parse(strings.NewReader(`<div><v noescape>.</v></div>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range tests {
+			nodes, err := tmpl.Evaluate(test.dot)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			expected := render(nodes)
+
+			div := &html.Node{Type: html.ElementNode, DataAtom: atom.Div, Data: "div"}
+			for _, child := range test.generated(policy) {
+				div.AppendChild(child)
+			}
+			if actual := render([]*html.Node{div}); actual != expected {
+				t.Errorf("Generated and evaluated output do not match for %#v:\n\tEvaluated: %q\n\tGenerated: %q", test.dot, expected, actual)
+			}
+		}
+	}
+}
+
+// Values of unknown types should be converted to strings as htmpl does
+func TestStringify(t *testing.T) {
+	node := &html.Node{Type: html.ElementNode, DataAtom: atom.B, Data: "b"}
+	tests := []struct {
+		v        interface{}
+		expected string
+	}{
+		{nil, ""},
+		{"a", "a"},
+		{-4.5, "-4.5"},
+		{(*int)(nil), ""},
+		{&node, "<b></b>"},
+		{[]*html.Node{node}, "<b></b>"},
+		{htmpl.HTML("<i>x</i>"), "<i>x</i>"},
+	}
+	for _, test := range tests {
+		if actual := Stringify(test.v); actual != test.expected {
+			t.Errorf("Stringify(%#v): expected %q, received %q", test.v, test.expected, actual)
+		}
+	}
+}
+
+// Join should convert elements to strings as htmpl.Evaluate does
+func TestJoin(t *testing.T) {
+	one, two := 1, 2
+	if actual, expected := Join([]*int{&one, nil, &two}, ","), "1,,2"; actual != expected {
+		t.Errorf("Join of pointers: expected %q, received %q", expected, actual)
+	}
+	if actual, expected := Join([]float64{1.5, 2}, "-"), "1.5-2"; actual != expected {
+		t.Errorf("Join of floats: expected %q, received %q", expected, actual)
+	}
+}
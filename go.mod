@@ -1,9 +1,14 @@
 module github.com/vktec/htmpl
 
-go 1.15
+go 1.22.0
 
 require (
 	github.com/vktec/htmlparse v0.0.0-20201212220732-bd458d57b27f
-	golang.org/x/net v0.0.0-20201209123823-ac852fbbde11
-	golang.org/x/tools v0.0.0-20201211192254-72fbef54948b
+	golang.org/x/net v0.30.0
+	golang.org/x/tools v0.26.0
+)
+
+require (
+	golang.org/x/mod v0.21.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
 )
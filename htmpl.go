@@ -2,231 +2,548 @@ package htmpl
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"go/token"
+	"io"
+	"io/fs"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/vktec/htmlparse"
+	"github.com/vktec/htmpl/internal/builtin"
+	"github.com/vktec/htmpl/internal/htmlpos"
 	"golang.org/x/net/html"
 )
 
+// Evaluate evaluates a template with the given value as dot.
+// Any problems in the template, such as bad variable paths, are silently treated as empty values.
 func Evaluate(node *html.Node, dot interface{}) []*html.Node {
-	eval := evaluator{make(map[string][]reflect.Value)}
+	t, _ := Compile(node)
+	out := newTreeOutput()
+	eval := t.newEvaluator(out, dot)
+	eval.exec(t.prog)
+	return out.nodes()
+}
+
+// EvaluateErr is like Evaluate, but returns an *Error describing the first problem found in the template.
+func EvaluateErr(node *html.Node, dot interface{}) ([]*html.Node, error) {
+	t, err := Compile(node)
+	if err != nil {
+		return nil, err
+	}
+	return t.Evaluate(dot)
+}
+
+// EvaluateSource parses src as a template and evaluates it.
+// Errors returned by EvaluateSource include the line and column in src at which the problem was found.
+func EvaluateSource(src []byte, dot interface{}) ([]*html.Node, error) {
+	t, err := Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return t.Evaluate(dot)
+}
+
+// A Template is a compiled template, which can be evaluated many times.
+// Templates are safe for concurrent use.
+type Template struct {
+	prog []instr
+
+	// The source of the template, used to recompile it as a layout
+	node *html.Node
+	file *file
+
+	components map[string]*component // The components available to templates including this one
+}
+
+// Parse parses and compiles a template, using the default configuration.
+// Errors in the template are returned as an *Error, including the line and column at which the problem was found.
+func Parse(r io.Reader) (*Template, error) {
+	return new(Config).Parse(r)
+}
+
+// Compile compiles an already-parsed template, using the default configuration.
+// The template retains references to the tree, so it must not be modified afterwards.
+func Compile(node *html.Node) (*Template, error) {
+	return new(Config).Compile(node)
+}
+
+// A Config specifies how templates are compiled and loaded.
+// A Config must not be copied or modified after it is first used, but is otherwise safe for concurrent use.
+type Config struct {
+	// FS is used to load templates by name, including those referenced by <include> elements.
+	// If nil, templates cannot be loaded by name.
+	FS fs.FS
+
+	// SortMaps causes all <for> elements to iterate over maps in the natural order of their keys, as if they had the sort attribute.
+	// See CompareKeys for the order used.
+	SortMaps bool
+
+	// StructTags causes struct fields to be indexed and iterated by the names in their htmpl struct tags,
+	// or their json struct tags if they have no htmpl tag, as encoding/json names them.
+	// Fields with the tag "-" are hidden, and fields without a name in their tag keep their Go name.
+	StructTags bool
+
+	// Funcs contains the functions that may be called from expressions in templates.
+	// The built-in functions (upper, lower, title, trim, truncate, join, default, len, first, last, slice, urlquery, json, pluralize and printf)
+	// are always available, but may be replaced by functions with the same names.
+	Funcs FuncMap
+
+	// Policy sanitizes the HTML substituted by <v noescape> elements, when it is parsed from a string.
+	// Values of type HTML, and values that are already HTML nodes, are trusted and not sanitized.
+	//
+	// Policy is nil by default, and if it is nil, the HTML is NOT sanitized, so <v noescape> must only be used with trusted values.
+	// Set it to DefaultPolicy() to sanitize user-generated content.
+	Policy *Policy
+
+	mu    sync.Mutex
+	cache map[string]*Template // Templates loaded from FS
+}
+
+// Parse parses and compiles a template.
+// Errors in the template are returned as an *Error, including the line and column at which the problem was found.
+func (c *Config) Parse(r io.Reader) (*Template, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.parse("", src, nil)
+}
+
+// Compile compiles an already-parsed template.
+// The template retains references to the tree, so it must not be modified afterwards.
+func (c *Config) Compile(node *html.Node) (*Template, error) {
+	return compile(c, &file{}, node, nil)
+}
+
+// ParseFile loads, parses and compiles the template with the given name from c.FS.
+// Templates are cached, so loading the same name again returns the same template.
+func (c *Config) ParseFile(name string) (*Template, error) {
+	return c.load(name, nil)
+}
+
+// load loads a template by name. stack contains the names of the templates that are currently being compiled.
+func (c *Config) load(name string, stack []string) (*Template, error) {
+	c.mu.Lock()
+	t := c.cache[name]
+	c.mu.Unlock()
+	if t != nil {
+		return t, nil
+	}
+
+	for _, n := range stack {
+		if n == name {
+			return nil, fmt.Errorf("template %q includes itself", name)
+		}
+	}
+	if c.FS == nil {
+		return nil, fmt.Errorf("cannot load template %q: no file system configured", name)
+	}
+	src, err := fs.ReadFile(c.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	t, err = c.parse(name, src, append(stack, name))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.cache == nil {
+		c.cache = make(map[string]*Template)
+	}
+	c.cache[name] = t
+	c.mu.Unlock()
+	return t, nil
+}
+
+func (c *Config) parse(name string, src []byte, stack []string) (*Template, error) {
+	node := &html.Node{Type: html.DocumentNode}
+	if err := htmlparse.Parse(node, src); err != nil {
+		if name != "" {
+			err = fmt.Errorf("%s: %w", name, err)
+		}
+		return nil, err
+	}
+	return compile(c, &file{name, htmlpos.Locate(src, node)}, node, stack)
+}
+
+// Evaluate evaluates the template with the given value as dot.
+// The returned nodes are newly allocated, and may be freely modified.
+func (t *Template) Evaluate(dot interface{}) ([]*html.Node, error) {
+	out := newTreeOutput()
+	eval := t.newEvaluator(out, dot)
+	eval.exec(t.prog)
+	if eval.err != nil {
+		return nil, eval.err
+	}
+	return out.nodes(), nil
+}
+
+// Execute evaluates the template with the given value as dot, writing the rendered HTML to w.
+// The output is identical to rendering the result of Evaluate with html.Render, but no intermediate nodes are constructed.
+// Evaluation continues after problems are found in the template, so output may be written even if an error is returned.
+func (t *Template) Execute(w io.Writer, dot interface{}) error {
+	out := newWriterOutput(w)
+	eval := t.newEvaluator(out, dot)
+	eval.exec(t.prog)
+	if err := out.flush(); err != nil {
+		return err
+	}
+	return eval.err
+}
+
+type evaluator struct {
+	out   output
+	vars  map[string][]reflect.Value
+	slots []slotFrame // The slot content of each component being evaluated
+	err   error
+}
+
+// A slotFrame holds the slot content provided by the caller of a component, along with the caller's variables
+type slotFrame struct {
+	slots map[string][]instr
+	vars  map[string][]reflect.Value
+}
+
+func (t *Template) newEvaluator(out output, dot interface{}) *evaluator {
+	eval := &evaluator{out: out, vars: make(map[string][]reflect.Value)}
 	vdot := reflect.ValueOf(dot)
 	eval.push(".", vdot)
 	eval.push("$", vdot)
-	return eval.eval(node)
+	return eval
 }
 
-type evaluator struct {
-	vars map[string][]reflect.Value
+// fail records a problem with an expression. Only the first problem is kept.
+func (eval *evaluator) fail(s *source, err error) {
+	if eval.err == nil {
+		eval.err = s.file.error(s.node, s.attr, s.src, err)
+	}
 }
 
-func (eval *evaluator) eval(node *html.Node) []*html.Node {
-	switch node.Type {
-	case html.DocumentNode:
-		return eval.children(node)
+// exec evaluates a sequence of instructions
+func (eval *evaluator) exec(prog []instr) {
+	for _, in := range prog {
+		eval.instr(in)
+	}
+}
 
-	case html.ElementNode:
-		switch node.Data {
-		case "if":
-			if isTruthy(eval.v(node)) {
-				return eval.children(node)
-			} else {
-				return nil
-			}
+func (eval *evaluator) instr(in instr) {
+	switch in := in.(type) {
+	case *staticInstr:
+		eval.out.static(in)
 
-		case "nif":
-			if !isTruthy(eval.v(node)) {
-				return eval.children(node)
-			} else {
-				return nil
-			}
+	case *elementInstr:
+		eval.out.open(in.node, eval.attrs(in.attrs))
+		eval.exec(in.body)
+		eval.out.close()
 
-		case "for":
-			return eval.iterate(node, eval.v(node))
-
-		case "let":
-			varName, _ := getAttr(node, "var")
-			valPath, _ := getAttr(node, "val")
-			eval.push(varName, eval.get(valPath))
-			nodes := eval.children(node)
-			eval.pop(varName)
-			return nodes
-
-		case "v":
-			// FIXME: should handle multiple child nodes
-			if node.FirstChild != nil && node.FirstChild.Type == html.TextNode {
-				path := node.FirstChild.Data
-				v := eval.get(path)
-				if _, ok := getAttr(node, "noescape"); ok {
-					if n, ok := nodes(v); ok {
-						return n
-					} else {
-						p := html.Node{}
-						htmlparse.Parse(&p, []byte(stringify(v)))
-						var children []*html.Node
-						for child := p.FirstChild; child != nil; child = child.NextSibling {
-							child.Parent = nil
-							child.NextSibling = nil
-							child.PrevSibling = nil
-							children = append(children, child)
-						}
-						return children
-					}
-				} else {
-					return []*html.Node{&html.Node{Type: html.TextNode, Data: stringify(v)}}
-				}
-			} else {
-				return nil
+	case *ifInstr:
+		if isTruthy(eval.eval(in.cond)) != in.negate {
+			eval.exec(in.body)
+		} else {
+			eval.exec(in.els)
+		}
+
+	case *switchInstr:
+		v := eval.eval(in.val)
+		for _, cs := range in.cases {
+			if cs.literal && stringify(v) == cs.is || !cs.literal && equal(v, eval.eval(cs.val)) {
+				eval.exec(cs.body)
+				return
 			}
+		}
+		eval.exec(in.def)
+
+	case *forInstr:
+		eval.iterate(in, eval.eval(in.coll))
+
+	case *letInstr:
+		eval.push(in.name, eval.eval(in.val))
+		eval.exec(in.body)
+		eval.pop(in.name)
+
+	case *includeInstr:
+		if in.tmpl == nil {
+			// The template failed to load
+			return
+		}
+		dot := eval.vars["."][len(eval.vars["."])-1]
+		if in.dot != nil {
+			dot = eval.eval(in.dot)
+		}
+		eval.push(".", dot)
+		eval.push("$", dot)
+		eval.exec(in.tmpl.prog)
+		eval.pop("$")
+		eval.pop(".")
+
+	case *componentInstr:
+		// Capture the caller's variables, limiting capacity so the originals are not overwritten by pushes
+		vars := make(map[string][]reflect.Value, len(eval.vars))
+		for name, v := range eval.vars {
+			vars[name] = v[:len(v):len(v)]
+		}
+		for _, attr := range in.attrs {
+			eval.push(attr.name, eval.eval(attr.val))
+		}
+		eval.slots = append(eval.slots, slotFrame{in.slots, vars})
+		eval.exec(in.comp.prog)
+		eval.slots = eval.slots[:len(eval.slots)-1]
+		for _, attr := range in.attrs {
+			eval.pop(attr.name)
+		}
+
+	case *slotInstr:
+		if len(eval.slots) == 0 {
+			eval.exec(in.body)
+			return
+		}
+		frame := eval.slots[len(eval.slots)-1]
+		content, ok := frame.slots[in.name]
+		if !ok {
+			eval.exec(in.body)
+			return
+		}
+		// Evaluate the content as the caller would, including any slots of an enclosing component
+		vars, slots := eval.vars, eval.slots
+		eval.vars, eval.slots = frame.vars, slots[:len(slots)-1]
+		eval.exec(content)
+		eval.vars, eval.slots = vars, slots
 
-		default:
-			ret := shallowClone(node)
-			for _, child := range eval.children(node) {
-				ret.AppendChild(child)
+	case *vInstr:
+		v := eval.eval(in.val)
+		if ctx, s, ok := trusted(v); ok && ctx == ContextText && in.ctx == ContextText {
+			// Trusted HTML is substituted as HTML even without noescape
+			for _, node := range parseHTML(s, nil) {
+				eval.out.node(node)
 			}
-			return []*html.Node{ret}
+		} else if in.noescape {
+			n, ok := nodes(v)
+			if !ok {
+				n = parseHTML(stringify(v), in.policy)
+			}
+			for _, node := range n {
+				eval.out.node(node)
+			}
+		} else {
+			eval.out.text(escape(in.ctx, v))
 		}
 
 	default:
-		return []*html.Node{shallowClone(node)}
+		panic("Invalid instruction")
 	}
 }
+
 func shallowClone(node *html.Node) *html.Node {
 	return &html.Node{
 		Type:      node.Type,
 		DataAtom:  node.DataAtom,
 		Data:      node.Data,
 		Namespace: node.Namespace,
+		Attr:      append([]html.Attribute(nil), node.Attr...),
 	}
 }
-
-// evalChildren evaluates all children of a given node
-func (eval *evaluator) children(node *html.Node) (nodes []*html.Node) {
+func deepClone(node *html.Node) *html.Node {
+	ret := shallowClone(node)
 	for child := node.FirstChild; child != nil; child = child.NextSibling {
-		nodes = append(nodes, eval.eval(child)...)
+		ret.AppendChild(deepClone(child))
 	}
-	return
+	return ret
+}
+
+// attrs evaluates the attributes of an ordinary element.
+// Attributes with a path have the value of that path substituted in.
+func (eval *evaluator) attrs(attrs []attrInstr) []html.Attribute {
+	ret := make([]html.Attribute, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr.val == nil {
+			ret = append(ret, attr.attr)
+			continue
+		}
+
+		v := eval.eval(attr.val)
+		if !v.IsValid() || v.Kind() == reflect.Bool {
+			// Boolean attributes are present iff the value is true
+			if isTruthy(v) {
+				ret = append(ret, attr.attr)
+			}
+			continue
+		}
+		a := attr.attr
+		a.Val = escape(attr.ctx, v)
+		ret = append(ret, a)
+	}
+	return ret
+}
+
+// A loop describes the current iteration of a <for> element, and is the value of the loop variable within it
+type loop struct {
+	Index  int         // The index of the item, starting from 0
+	Number int         // The index of the item, starting from 1
+	Length int         // The number of items, or 0 if unknown
+	First  bool        // Whether the item is the first
+	Last   bool        // Whether the item is the last, if the length is known
+	Key    interface{} // The key of the item: its index in an array, or its key in a map
+	Value  interface{} // The item itself
 }
 
-// iterate evaluates all children of a given node, once for each item in the specified collection
-func (eval *evaluator) iterate(node *html.Node, v reflect.Value) (nodes []*html.Node) {
+// iterate evaluates the body of a <for> element once for each item in the specified collection
+func (eval *evaluator) iterate(in *forInstr, v reflect.Value) {
+	l := &loop{}
+	eval.push("loop", reflect.ValueOf(l).Elem())
+	item := func(key, value, dot reflect.Value) {
+		l.Number = l.Index + 1
+		l.First = l.Index == 0
+		l.Last = l.Index == l.Length-1
+		l.Key, l.Value = iface(key), iface(value)
+		eval.push(".", dot)
+		if in.key != "" {
+			eval.push(in.key, key)
+		}
+		if in.val != "" {
+			eval.push(in.val, value)
+		}
+		eval.exec(in.body)
+		if in.val != "" {
+			eval.pop(in.val)
+		}
+		if in.key != "" {
+			eval.pop(in.key)
+		}
+		eval.pop(".")
+		l.Index++
+	}
+
+	if in.to != nil {
+		from, to, step := 1, 0, 1
+		ok := eval.bound(in.from, &from) && eval.bound(in.to, &to) && eval.bound(in.step, &step)
+		if ok && step == 0 {
+			eval.fail(in.step.source, errors.New("step must not be zero"))
+			ok = false
+		}
+		if ok {
+			l.Length = builtin.RangeLength(from, to, step)
+		}
+		for x := from; l.Index < l.Length; x += step {
+			item(reflect.ValueOf(l.Index), reflect.ValueOf(x), reflect.ValueOf(x))
+		}
+		eval.pop("loop")
+		return
+	}
+
 	switch v.Kind() {
 	case reflect.Invalid:
-		nodes = nil
 	case reflect.Array, reflect.Slice:
+		l.Length = v.Len()
 		for i := 0; i < v.Len(); i++ {
-			eval.push(".", v.Index(i))
-			nodes = append(nodes, eval.children(node)...)
-			eval.pop(".")
+			item(reflect.ValueOf(i), v.Index(i), v.Index(i))
 		}
 	case reflect.Chan:
 		x, ok := v.Recv()
 		for ok {
-			eval.push(".", x)
-			nodes = append(nodes, eval.children(node)...)
+			item(reflect.ValueOf(l.Index), x, x)
 			x, ok = v.Recv()
-			eval.pop(".")
 		}
 	case reflect.Map:
+		l.Length = v.Len()
+		if in.sorted {
+			keys := v.MapKeys()
+			sort.SliceStable(keys, func(i, j int) bool {
+				return compareKeys(unwrap(keys[i]), unwrap(keys[j])) < 0
+			})
+			for _, key := range keys {
+				item(key, v.MapIndex(key), key)
+			}
+			break
+		}
 		for it := v.MapRange(); it.Next(); {
-			eval.push(".", it.Key())
-			nodes = append(nodes, eval.children(node)...)
-			eval.pop(".")
+			item(it.Key(), it.Value(), it.Key())
 		}
 	case reflect.Struct:
-		for i := 0; i < v.NumField(); i++ {
-			eval.push(".", v.Field(i))
-			nodes = append(nodes, eval.children(node)...)
-			eval.pop(".")
+		fs := fields(v.Type(), in.tags)
+		l.Length = len(fs)
+		for _, f := range fs {
+			fv := fieldByIndex(v, f.Index)
+			item(reflect.ValueOf(f.Name), fv, fv)
 		}
 	default:
-		nodes = eval.children(node)
+		l.Length = 1
+		item(reflect.ValueOf(0), v, v)
 	}
-	return
-}
-
-func (eval *evaluator) v(node *html.Node) reflect.Value {
-	v, _ := getAttr(node, "v")
-	return eval.get(v)
-}
-func getAttr(node *html.Node, key string) (string, bool) {
-	for _, attr := range node.Attr {
-		if attr.Key == key {
-			return attr.Val, true
-		}
-	}
-	return "", false
+	eval.pop("loop")
 }
 
-func (eval *evaluator) get(pathString string) reflect.Value {
-	v, _ := eval.get_([]byte(strings.Trim(pathString, " \t\r\n")), false)
-	return v
-}
-func (eval *evaluator) get_(pbytes []byte, nested bool) (reflect.Value, []byte) {
-	if len(pbytes) == 0 {
-		return reflect.Value{}, nil
+// bound evaluates a bound of a numeric range into *n, returning false if it is not an integer.
+// If the bound is nil, *n is left unchanged, and an empty is treated as 0.
+func (eval *evaluator) bound(b *boundExpr, n *int) bool {
+	if b == nil {
+		return true
 	}
-	var path []string
-	if pbytes[0] == '.' {
-		path = append(path, ".")
-		pbytes = pbytes[1:]
+	v := eval.eval(b.val)
+	switch {
+	case !v.IsValid():
+		*n = 0
+	case v.CanInt() && v.Int() >= math.MinInt && v.Int() <= math.MaxInt:
+		*n = int(v.Int())
+	case v.CanUint() && v.Uint() <= math.MaxInt:
+		*n = int(v.Uint())
+	case v.CanFloat() && v.Float() == math.Trunc(v.Float()) && v.Float() >= math.MinInt && v.Float() < math.MaxInt:
+		*n = int(v.Float())
+	case v.CanInt() || v.CanUint() || v.CanFloat() && v.Float() == math.Trunc(v.Float()):
+		eval.fail(b.source, fmt.Errorf("%s is out of range", stringify(v)))
+		return false
+	default:
+		eval.fail(b.source, fmt.Errorf("%s is not an integer", stringify(v)))
+		return false
 	}
+	return true
+}
 
-parseLoop:
-	for {
-		idx := bytes.IndexAny(pbytes, ".[]")
-		if idx < 0 {
-			if nested {
-				return reflect.Value{}, nil
-			} else {
-				if len(pbytes) > 0 {
-					path = append(path, string(pbytes))
-					pbytes = nil
-				}
-				break
-			}
-		}
-
-		prebytes := pbytes[:idx]
-		sep := pbytes[idx]
-		pbytes = pbytes[idx+1:]
-
-		switch sep {
-		case '.':
-			path = append(path, string(prebytes))
-		case '[':
-			var v reflect.Value
-			v, pbytes = eval.get_(pbytes, true)
-			path = append(path, stringify(v))
-		case ']':
-			if nested {
-				break parseLoop
-			} else {
-				return reflect.Value{}, nil
-			}
-		}
+// iface returns the value held by v, or nil if it is empty or cannot be accessed
+func iface(v reflect.Value) interface{} {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
 	}
+	return v.Interface()
+}
 
-	if len(path) == 0 {
-		return reflect.Value{}, nil
+// get retrieves the value of a variable path
+func (eval *evaluator) get(p *path) reflect.Value {
+	if p == nil {
+		// The path failed to compile
+		return reflect.Value{}
 	}
 
-	vals := eval.vars[path[0]]
+	vals := eval.vars[p.head]
 	if len(vals) == 0 {
-		return reflect.Value{}, nil
+		eval.fail(p.source, fmt.Errorf("undefined variable %q", p.head))
+		return reflect.Value{}
 	}
 	v := vals[len(vals)-1]
 
-	for _, part := range path[1:] {
-		v = index(v, part)
+	for _, key := range p.keys {
+		name := key.name
+		if key.path != nil {
+			name = stringify(eval.get(key.path))
+		}
+
+		var err error
+		v, err = key.index(v, name, p.tags)
+		if err != nil {
+			eval.fail(p.source, err)
+			return reflect.Value{}
+		}
 		if !v.IsValid() {
 			break
 		}
 	}
-	return v, pbytes
+	return v
 }
 
 func (eval *evaluator) push(varName string, v reflect.Value) {
@@ -250,23 +567,251 @@ func isTruthy(v reflect.Value) bool {
 	}
 }
 
-func index(v reflect.Value, key string) reflect.Value {
+// index indexes a value with the given key.
+// Values implementing Lookuper are indexed by calling Lookup.
+// Otherwise, struct fields, elements and map keys are found first, and an exported method of the value is called if the key cannot name any of them,
+// so adding a method to a type never changes the meaning of an existing path.
+// If tags is true, struct fields are indexed by the names in their struct tags; see Config.StructTags.
+// An error is returned if the key can never be valid for the value's type.
+func index(v reflect.Value, key string, tags bool) (reflect.Value, error) {
+	if r, ok := lookup(v, key); ok {
+		return unwrap(r), nil
+	}
 	switch v.Kind() {
 	case reflect.Array, reflect.Slice:
-		i, err := strconv.Atoi(key)
-		if err != nil || i < 0 || i > v.Len() {
-			return reflect.Value{}
+		if i, err := strconv.Atoi(key); err == nil {
+			if i < 0 || i >= v.Len() {
+				return reflect.Value{}, nil
+			}
+			return unwrap(v.Index(i)), nil
 		}
-		v = v.Index(i)
 	case reflect.Map:
-		v = v.MapIndex(reflect.ValueOf(key))
+		if k, ok := mapKey(key, v.Type().Key()); ok {
+			return unwrap(v.MapIndex(k)), nil
+		}
 	case reflect.Struct:
-		v = v.FieldByName(key)
-	default:
+		if f, ok := fieldByName(v.Type(), key, tags); ok {
+			return unwrap(fieldByIndex(v, f.Index)), nil
+		}
+	}
+	if r, ok, err := method(v, key); ok {
+		return unwrap(r), err
+	}
+	if v.Kind() == reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("no field %q in type %s", key, v.Type())
+	}
+	return reflect.Value{}, nil
+}
+
+// A Lookuper is a value that controls how it is indexed by variable paths.
+// Indexing a Lookuper with a key results in the value returned by Lookup, or an empty if ok is false.
+type Lookuper interface {
+	Lookup(key string) (value interface{}, ok bool)
+}
+
+var lookuperType = reflect.TypeOf((*Lookuper)(nil)).Elem()
+
+// lookup indexes a value implementing Lookuper, and reports whether it does.
+// As with methods, Lookup is called on a copy of the value if it has a pointer receiver and the value is not addressable.
+func lookup(v reflect.Value, key string) (reflect.Value, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return reflect.Value{}, false
+	}
+	recv := v
+	if v.CanAddr() {
+		recv = v.Addr()
+	} else if !v.Type().Implements(lookuperType) && reflect.PointerTo(v.Type()).Implements(lookuperType) {
+		recv = reflect.New(v.Type())
+		recv.Elem().Set(v)
+	}
+	l, ok := recv.Interface().(Lookuper)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	r, ok := l.Lookup(key)
+	if !ok {
+		return reflect.Value{}, true
+	}
+	return reflect.ValueOf(r), true
+}
+
+// method calls the exported method of a value with the given name, and reports whether it exists.
+// Methods with pointer receivers are called on a copy of the value if it is not addressable.
+// Only methods that take no arguments, and return one value or a value and an error, are considered.
+func method(v reflect.Value, name string) (reflect.Value, bool, error) {
+	if !v.IsValid() || !v.CanInterface() || !token.IsExported(name) {
+		return reflect.Value{}, false, nil
+	}
+	recv := v
+	if v.CanAddr() {
+		recv = v.Addr()
+	} else if _, ok := reflect.PointerTo(v.Type()).MethodByName(name); ok {
+		recv = reflect.New(v.Type())
+		recv.Elem().Set(v)
+	}
+	m := recv.MethodByName(name)
+	if !m.IsValid() {
+		return reflect.Value{}, false, nil
+	}
+	if t := m.Type(); t.NumIn() != 0 || t.NumOut() < 1 || t.NumOut() > 2 || t.NumOut() == 2 && t.Out(1) != errorType {
+		return reflect.Value{}, false, nil
+	}
+	out := m.Call(nil)
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, true, fmt.Errorf("calling method %q: %w", name, out[1].Interface().(error))
+	}
+	return out[0], true, nil
+}
+
+// fieldByIndex returns the field of a struct with the given index sequence, or an empty if it is promoted through a nil pointer
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	v, err := v.FieldByIndexErr(index)
+	if err != nil {
 		return reflect.Value{}
 	}
-	return unwrap(v)
+	return v
+}
+
+// fieldByName finds the field of a struct type with the given name.
+// Only the fields returned by fields can be found, so unexported fields and embedded structs themselves are hidden.
+// If tags is true, fields are named by their struct tags.
+func fieldByName(t reflect.Type, name string, tags bool) (reflect.StructField, bool) {
+	for _, f := range fields(t, tags) {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// tagName returns the name of a field given by its htmpl struct tag, or its json struct tag if it has no htmpl tag.
+// The field is hidden if the tag is "-".
+func tagName(tag reflect.StructTag) (name string, hidden bool) {
+	for _, key := range []string{"htmpl", "json"} {
+		if val, ok := tag.Lookup(key); ok {
+			name, _, _ = strings.Cut(val, ",")
+			return name, name == "-" && val == "-"
+		}
+	}
+	return "", false
+}
+
+// structFields caches the result of fields for each type
+var structFields sync.Map // map[fieldsKey][]reflect.StructField
+
+type fieldsKey struct {
+	t    reflect.Type
+	tags bool
+}
+
+// fields returns the exported fields of a struct type that can be accessed by name, in order.
+// The fields of embedded structs are promoted following Go's rules, and replace the embedded field itself.
+// If tags is true, fields are renamed or hidden by their struct tags, and embedded structs with a name in their tag are not promoted, as in encoding/json.
+func fields(t reflect.Type, tags bool) []reflect.StructField {
+	if fs, ok := structFields.Load(fieldsKey{t, tags}); ok {
+		return fs.([]reflect.StructField)
+	}
+
+	type candidate struct {
+		f        reflect.StructField
+		depth    int
+		embedded bool // Embedded structs take part in name resolution, but are replaced by their fields
+		tagged   bool // Whether the field was named by a struct tag
+	}
+	var all []candidate
+	seen := map[reflect.Type]bool{t: true}
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			f.Index = append(index[:len(index):len(index)], i)
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			embedded := f.Anonymous && ft.Kind() == reflect.Struct
+			tagged := false
+			if tags {
+				name, hidden := tagName(f.Tag)
+				if hidden {
+					continue
+				}
+				if name != "" {
+					f.Name, embedded, tagged = name, false, true
+				}
+			}
+			all = append(all, candidate{f, len(index), embedded, tagged})
+			if embedded && !seen[ft] {
+				seen[ft] = true
+				walk(ft, f.Index)
+				delete(seen, ft)
+			}
+		}
+	}
+	walk(t, nil)
+
+	// A name refers to the shallowest field with that name, if there is exactly one.
+	// As in encoding/json, a single field named by a tag takes precedence over others at the same depth.
+	best := make(map[string][]int) // The indices in all of the shallowest fields with each name
+	for i, c := range all {
+		if b := best[c.f.Name]; len(b) == 0 || c.depth < all[b[0]].depth {
+			best[c.f.Name] = []int{i}
+		} else if c.depth == all[b[0]].depth {
+			best[c.f.Name] = append(b, i)
+		}
+	}
+	var fs []reflect.StructField
+	for i, c := range all {
+		if c.embedded || !c.f.IsExported() {
+			continue
+		}
+		b := best[c.f.Name]
+		if len(b) > 1 {
+			var tagged []int
+			for _, j := range b {
+				if all[j].tagged {
+					tagged = append(tagged, j)
+				}
+			}
+			b = tagged
+		}
+		if len(b) == 1 && b[0] == i {
+			fs = append(fs, c.f)
+		}
+	}
+	structFields.Store(fieldsKey{t, tags}, fs)
+	return fs
 }
+
+// mapKey converts a key to the key type of a map, returning false if it can never be present in the map
+func mapKey(key string, t reflect.Type) (reflect.Value, bool) {
+	k := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		k.SetString(key)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(key, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, false
+		}
+		k.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := strconv.ParseUint(key, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, false
+		}
+		k.SetUint(i)
+	case reflect.Interface:
+		if !reflect.TypeOf(key).Implements(t) {
+			return reflect.Value{}, false
+		}
+		k.Set(reflect.ValueOf(key))
+	default:
+		return reflect.Value{}, false
+	}
+	return k, true
+}
+
 func unwrap(v reflect.Value) reflect.Value {
 	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
 		if v.IsNil() {
@@ -277,6 +822,7 @@ func unwrap(v reflect.Value) reflect.Value {
 	return v
 }
 
+// nodes returns the nodes of a value that is already HTML, which is trusted: an html.Node, a []*html.Node, or a string of a trusted HTML type
 func nodes(v reflect.Value) ([]*html.Node, bool) {
 	if !v.CanInterface() {
 		return nil, false
@@ -288,12 +834,18 @@ func nodes(v reflect.Value) ([]*html.Node, bool) {
 	case []*html.Node:
 		return iv, true
 	}
+	if ctx, s, ok := trusted(v); ok && ctx == ContextText {
+		return parseHTML(s, nil), true
+	}
 	return nil, false
 }
 func stringify(v reflect.Value) string {
 	if !v.IsValid() {
 		return ""
 	}
+	if _, s, ok := trusted(v); ok {
+		return s
+	}
 	if n, ok := nodes(v); ok {
 		b := strings.Builder{}
 		for _, node := range n {
@@ -301,5 +853,16 @@ func stringify(v reflect.Value) string {
 		}
 		return b.String()
 	}
+	if v.Type().NumMethod() == 0 {
+		// Fast paths for basic types, avoiding the cost of fmt
+		switch v.Kind() {
+		case reflect.String:
+			return v.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.FormatInt(v.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return strconv.FormatUint(v.Uint(), 10)
+		}
+	}
 	return fmt.Sprint(v) // TODO: improve this
 }
@@ -1,9 +1,18 @@
 package htmpl
 
 import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/vktec/htmlparse"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 )
@@ -27,6 +36,9 @@ func testFrag(t *testing.T, dot interface{}, input, output string) {
 	for _, child := range nodes {
 		root.AppendChild(child)
 	}
+	if fragCases != nil {
+		fragCases.add(t, dot, input, output)
+	}
 	nodes = Evaluate(root, dot)
 
 	newRoot := &html.Node{Type: html.DocumentNode}
@@ -42,6 +54,18 @@ func testFrag(t *testing.T, dot interface{}, input, output string) {
 	if b.String() != output {
 		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", output, b.String())
 	}
+
+	// Streaming output should be identical
+	tmpl, err := Compile(root)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	b.Reset()
+	tmpl.Execute(&b, dot)
+	if b.String() != output {
+		t.Errorf("Expected and actual streamed output do not match:\n\tExpected: %q\n\tReceived: %q", output, b.String())
+	}
 }
 
 // Static HTML should not be modified
@@ -102,6 +126,23 @@ func TestV(t *testing.T) {
 		-76.3
 		c
 	`)
+	// Bracketed keys are looked up independently
+	testFrag(t, testData{
+		Baz:  map[string]interface{}{"world": -76.3},
+		Quux: []string{"hello", "world"},
+	}, `
+		<v>.Baz[.Quux.1]</v>
+	`, `
+		-76.3
+	`)
+	// Keys are converted to the key type of maps
+	testFrag(t, map[string]interface{}{
+		"ints":  map[int8]string{-1: "a", 3: "b"},
+		"uints": map[uint]string{3: "c"},
+		"keys":  []interface{}{3, "-1", "x"},
+	}, `
+		<v>.ints.3</v><v>.ints[.keys.1]</v><v>.uints[.keys.0]</v><v>.ints[.keys.2]</v><v>.uints[.keys.1]</v><v>.ints.300</v>
+	`, `bac`)
 }
 
 // <if> should render its contents iff the condition is truthy
@@ -176,6 +217,213 @@ func TestNif(t *testing.T) {
 	`)
 }
 
+// <elif> and <else> should render their contents iff no previous branch was taken
+func TestElse(t *testing.T) {
+	for expected, dot := range map[string]map[string]bool{
+		"a":    {"a": true, "b": true},
+		"b":    {"b": true},
+		"none": {},
+	} {
+		// Branches within the conditional element
+		testFrag(t, dot, `
+			<if v=".a">
+				a
+				<elif v=".b">b</elif>
+				<else>none</else>
+			</if>
+		`, expected)
+		// Branches following the conditional element
+		testFrag(t, dot, `
+			<if v=".a">a</if>
+			<!-- comment -->
+			<elif v=".b">b</elif>
+			<else>none</else>
+		`, expected)
+	}
+	testFrag(t, map[string]bool{"t": true, "f": false}, `
+		<if v=".f">
+			a
+		</if>
+		<else>
+			<if v=".t">b<else>c</else></if>
+		</else>
+		<if v=".t">d</if>
+		<elif v=".f">e</elif>
+	`, `bd`)
+	testFrag(t, nil, `<if v=".">a</if> <p>b</p>`, ` <p>b</p>`)
+}
+
+// <switch> should render the contents of the first matching <case>, or <default> if there is none
+func TestSwitch(t *testing.T) {
+	for dot, expected := range map[string]string{"shipped": "Shipped", "pending": "Pending", "lost": "Unknown"} {
+		testFrag(t, dot, `
+			<switch v=".">
+				<!-- Statuses -->
+				<case is="pending">Pending</case>
+				<default>Unknown</default>
+				<case is="shipped">Shipped</case>
+				<case is="shipped">Duplicate</case>
+			</switch>
+		`, expected)
+	}
+	testFrag(t, map[string]interface{}{"n": 3, "b": true, "f": 1.5, "u": uint8(3), "stringer": time.March}, `
+		<switch v=".n"><case is="3">n</case></switch>
+		<switch v=".b"><case is="false">x</case><case is="true">b</case></switch>
+		<switch v=".f"><case is="1.5">f</case></switch>
+		<switch v=".stringer"><case is="3">x</case><case is="March">s</case></switch>
+		<switch v=".missing"><case is="">e</case></switch>
+		<switch v=".n"><case v=".u">u</case></switch>
+		<switch v=".n"><case v=".f">x</case><default>d</default></switch>
+	`, `nbfseud`)
+}
+
+// Values should be equal iff they have the same type and contents
+func TestEqual(t *testing.T) {
+	type point struct{ X, Y int }
+	for _, c := range []struct {
+		a, b  interface{}
+		equal bool
+	}{
+		{nil, nil, true},
+		{nil, 0, false},
+		{(*int)(nil), nil, true},
+		{true, true, true},
+		{true, 1, false},
+		{3, 3.0, true},
+		{int8(-1), uint8(255), false},
+		{uint64(1 << 63), int64(-1 << 63), false},
+		{float32(0.5), 0.5, true},
+		{"a", "a", true},
+		{"1", 1, false},
+		{[]int{1, 2}, [2]float64{1, 2}, true},
+		{[]int{1, 2}, []int{1}, false},
+		{[]interface{}{"a", nil}, []string{"a", ""}, false},
+		{map[string]int{"a": 1}, map[string]float64{"a": 1}, true},
+		{map[string]int{"a": 1}, map[string]int{"b": 1}, false},
+		{map[string]int{}, map[int]int{}, true},
+		{point{1, 2}, point{1, 2}, true},
+		{point{1, 2}, &point{1, 3}, false},
+		{[]func(){nil}, []func(){nil}, false},
+	} {
+		if Equal(c.a, c.b) != c.equal || Equal(c.b, c.a) != c.equal {
+			t.Errorf("Expected Equal(%#v, %#v) to be %v", c.a, c.b, c.equal)
+		}
+	}
+}
+
+// Expressions should support literals, comparisons and boolean operators
+func TestExpr(t *testing.T) {
+	testFrag(t, map[string]interface{}{"count": 12, "a": true, "b": false, "name": "bob", "f": 2.5, "u": uint(3)}, `
+		<if v=".count > 10">big</if>
+		<if v=".count<=12">,le</if>
+		<if v=".a and not .b">,and</if>
+		<if v="not (.a or .b)">,x</if>
+		<if v=".b or .a and .count == 12">,prec</if>
+		<if v='.name == "bob"'>,str</if>
+		<if v=".name != 'bob'">,x</if>
+		<if v=".name < 'carol'">,lt</if>
+		<if v=".f >= 2.5 and .f < 3">,float</if>
+		<if v=".u == 3 and -1 < .u">,uint</if>
+		<if v=".name > 3">,x</if>
+		<if v=".missing == .alsoMissing">,empty</if>
+		,<v>'it\'s' == "it's"</v>
+		,<v>-1.5e1</v>
+		<span v:title="not .a"></span><span v:hidden="not .b"></span>
+	`, `
+		big,le,and,prec,str,lt,float,uint,empty,true,-15<span></span><span hidden=""></span>
+	`)
+}
+
+// The built-in functions should be available without configuration
+func TestBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"name":  "  ada lovelace ",
+		"tags":  []string{"a", "b", "c"},
+		"nums":  [3]int{1, 2, 3},
+		"empty": []int{},
+		"m":     map[string]int{"x": 1},
+		"zero":  0,
+		"one":   1,
+		"price": 2.5,
+	}
+	testFrag(t, data, `<v>'Hello' | upper</v>,<v>'Hello' | lower</v>`, `HELLO,hello`)
+	testFrag(t, data, `<v>.name | trim | title</v>,<v>'élan vital' | title</v>`, `Ada Lovelace,Élan Vital`)
+	testFrag(t, data, `<v>.name | trim</v>,`, `ada lovelace,`)
+	testFrag(t, data, `<v>'héllo' | truncate 2</v>,<v>'hi' | truncate 2</v>,<v>'hi' | truncate -1</v>`, `hé…,hi,…`)
+	testFrag(t, data, `<v>.tags | join ', '</v>,<v>.nums | join '-'</v>,<v>.missing | join ','</v>`, `a, b, c,1-2-3,`)
+	testFrag(t, data, `<v>.missing | default 'none'</v>,<v>.zero | default 5</v>,<v>.one | default 5</v>,<v>.empty | default 'x'</v>`, `none,5,1,x`)
+	testFrag(t, data, `<v>.tags | len</v>,<v>'héllo' | len</v>,<v>.m | len</v>,<v>.missing | len</v>,<if v="(.empty | len) == 0">empty</if>`, `3,5,1,0,empty`)
+	testFrag(t, data, `<v>.tags | first</v>,<v>.nums | last</v>,<v>.empty | first</v>,<v>.tags | last | upper</v>`, `a,3,,C`)
+	testFrag(t, data, `<v>.tags | slice 1 | join ''</v>,<v>.nums | slice 0 2 | join ''</v>,<v>'héllo' | slice 1 3</v>,<v>.tags | slice 2 10 | join ''</v>,<v>'abc' | slice 5</v>`, `bc,12,él,c,`)
+	testFrag(t, data, `<a v:title=".name | trim | urlquery"></a><v>'a&b c' | urlquery</v>`, `<a title="ada+lovelace"></a>a%26b+c`)
+	testFrag(t, data, `<v>.tags | json</v>,<v>.m | json</v>`, `[&#34;a&#34;,&#34;b&#34;,&#34;c&#34;],{&#34;x&#34;:1}`)
+	testFrag(t, data, `<v>.one | pluralize 'item' 'items'</v>,<v>.zero | pluralize 'item' 'items'</v>,<v>.tags | len | pluralize 'tag' 'tags'</v>`, `item,items,tags`)
+	testFrag(t, data, `<v>.price | printf '%.2f'</v>,<v>.one | printf '%d of %d' 3</v>`, `2.50,1 of 3`)
+	// Elements are joined as they would be substituted, so pointers are followed
+	one, two := 1, 2
+	testFrag(t, map[string][]*int{"ptrs": {&one, nil, &two}}, `<v>.ptrs | join ','</v>`, `1,,2`)
+
+	// Functions in Config.Funcs replace the built-in functions
+	config := &Config{Funcs: FuncMap{"upper": func(s string) string { return s + "!" }}}
+	tmpl, err := config.Parse(strings.NewReader(`<v>'a' | upper</v><v>'a' | lower</v>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, nil); err != nil {
+		t.Error(err)
+	}
+	if expected := `a!a`; b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+}
+
+// Functions should be callable using pipes
+func TestFuncs(t *testing.T) {
+	config := &Config{Funcs: FuncMap{
+		"date":   func(t time.Time, layout string) string { return t.Format(layout) },
+		"add":    func(a, b int64) int64 { return a + b },
+		"concat": func(s ...string) string { return strings.Join(s, "") },
+		"ptr":    func(d *time.Time) int { return d.Year() },
+		"fail": func(s string) (string, error) {
+			if s == "" {
+				return "", errors.New("empty string")
+			}
+			return s, nil
+		},
+	}}
+	tmpl, err := config.Parse(strings.NewReader(`<v>.Created | date "2006-01-02"</v> <v>.N | add 2 | add .N</v> <v>'a' | concat</v><v>'a' | concat "b" ('c' | concat 'd')</v> <v>.Ptr | ptr</v> <if v="(.N | add 1) > 3">x</if><span v:title=".Name | fail"></span>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, map[string]interface{}{"Created": created, "N": 3, "Name": "bob", "Ptr": &created}); err != nil {
+		t.Error(err)
+	}
+	if expected := `2024-03-01 8 aabcd 2024 x<span title="bob"></span>`; b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+
+	for src, expected := range map[string]string{
+		`<v>.N | missing</v>`:  `1:1: <v> path ".N | missing": undefined function "missing"`,
+		`<v>.N | add</v>`:      `1:1: <v> path ".N | add": wrong number of arguments to "add": expected 2, received 1`,
+		`<v>.N |</v>`:          `1:1: <v> path ".N |": missing function name after '|'`,
+		`<v>.N | add 1 2</v>`:  `1:1: <v> path ".N | add 1 2": wrong number of arguments to "add": expected 2, received 3`,
+		`<v>.Name | fail</v>`:  `1:1: <v> path ".Name | fail": calling "fail": empty string`,
+		`<v>.Name | add 1</v>`: `1:1: <v> path ".Name | add 1": argument 1 to "add": cannot use string as int64`,
+		`<v>1.5 | add 1</v>`:   `1:1: <v> path "1.5 | add 1": argument 1 to "add": 1.5 cannot be represented by int64`,
+	} {
+		tmpl, err := config.Parse(strings.NewReader(src))
+		if err == nil {
+			err = tmpl.Execute(io.Discard, map[string]interface{}{"N": 1, "Name": ""})
+		}
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q, received %v", expected, err)
+		}
+	}
+}
+
 // <for> should render its contents once for each item in a collection
 func TestFor(t *testing.T) {
 	testFrag(t, []string{}, `
@@ -202,14 +450,264 @@ func TestFor(t *testing.T) {
 		Jim
 		Fred
 	`)
-	testFrag(t, map[string]int{"apples": 3, "bananas": 7}, `
+
+	// Maps are iterated in a random order, so sort them to check the output
+	config := &Config{SortMaps: true}
+	tmpl, err := config.Parse(strings.NewReader(nltabRemover.Replace(`
 		<for v=".">
-			<v>.</v>: <v>$.map[.]</v>
+			<v>.</v>: <v>$[.]</v>
 		</for>
-	`, `
+	`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, map[string]int{"apples": 3, "bananas": 7}); err != nil {
+		t.Error(err)
+	}
+	if expected := nltabRemover.Replace(`
 		apples: 3
 		bananas: 7
-	`)
+	`); b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+}
+
+// <for> should bind the key and value of each item to the named variables
+func TestForKeyVal(t *testing.T) {
+	testFrag(t, map[string]map[string]int{"m": {"apples": 3, "bananas": 7}}, `
+		<for v=".m" key="k" val="n" sort><v>k</v>: <v>n</v>,</for>
+	`, `apples: 3,bananas: 7,`)
+	testFrag(t, []string{"a", "b"}, `
+		<for v="." key="i" val="x"><v>i</v>=<v>x</v><for v="$" val="y">(<v>i</v><v>y</v>)</for>,</for>
+		<v>i</v>
+	`, `0=a(0a)(0b),1=b(1a)(1b),`)
+	type point struct{ X, Y int }
+	testFrag(t, point{1, 2}, `
+		<for v="." key="name" val="v"><v>name</v>=<v>v</v>/<v>.</v> </for>
+	`, `X=1/1 Y=2/2 `)
+}
+
+type embeddedBase struct {
+	ID   int
+	Name string
+}
+type embeddedMeta struct{ Name, Note string }
+type embeddedHidden struct{ Shown string }
+type embeddedData struct {
+	*embeddedBase
+	embeddedMeta
+	embeddedHidden
+	Title  string
+	hidden string
+}
+
+// Fields of embedded structs should be promoted following Go's rules
+func TestEmbedded(t *testing.T) {
+	data := embeddedData{
+		embeddedBase:   &embeddedBase{1, "base"},
+		embeddedMeta:   embeddedMeta{"meta", "note"},
+		embeddedHidden: embeddedHidden{"shown"},
+		Title:          "T",
+		hidden:         "h",
+	}
+	testFrag(t, data, `<v>.ID</v>,<v>.Note</v>,<v>.Shown</v>`, `1,note,shown`)
+	// Unexported fields, embedded structs themselves and ambiguous names are hidden, as they are from <for>
+	testFrag(t, data, `<v>.hidden</v>,<v>.embeddedMeta</v>,<v>.embeddedHidden.Shown</v>,<v>.Name</v>`, `,,,`)
+	testFrag(t, data, `<for v="." key="k" val="v"><v>k</v>=<v>v</v>;</for>`, `ID=1;Note=note;Shown=shown;Title=T;`)
+	testFrag(t, embeddedData{Title: "T"}, `<v>.ID</v>,<for v="." key="k"><v>k</v>=<v>.</v>;</for>`, `,ID=;Note=;Shown=;Title=T;`)
+}
+
+type methodUser struct{ First, Last string }
+
+func (u methodUser) DisplayName() string   { return u.First + " " + u.Last }
+func (u *methodUser) Initials() string     { return u.First[:1] + u.Last[:1] }
+func (u methodUser) Active() (bool, error) { return u.First != "", nil }
+func (u methodUser) Greet(name string) string {
+	return "hello " + name
+}
+
+type methodTags []string
+
+func (t methodTags) Count() int { return len(t) }
+
+type methodCounts map[string]int
+
+func (c methodCounts) Total() int { return len(c) }
+
+type methodMeta struct{ Name string }
+type methodNamed struct{ methodMeta }
+
+func (methodNamed) Name() string { return "method" }
+
+// Paths following nil pointers should be empty
+func TestNilPointer(t *testing.T) {
+	type item struct {
+		Name string
+		Tags *[]string
+	}
+	type data struct {
+		Item  *item
+		Items *[]string
+		N     *int
+		NP    **int
+	}
+	template := `
+		<v>.Item.Name</v>|<for v=".Item.Tags"><v>.</v>,</for>|<for v=".Items"><v>.</v>,</for>|
+		<switch v=".Item.Name"><case is="">empty</case><default>other</default></switch>|<v>.N</v>|<v>.NP</v>|
+		<p v:title=".N"></p><if v=".Item">item</if><if v=".N">n</if>
+	`
+	testFrag(t, data{}, template, `|||empty|||<p></p>`)
+
+	n := 2
+	np := &n
+	testFrag(t, data{&item{"x", &[]string{"a", "b"}}, &[]string{"c"}, &n, &np}, template, `x|a,b,|c,|other|2|2|<p title="2"></p>itemn`)
+}
+
+// Methods should be callable from variable paths
+func TestMethods(t *testing.T) {
+	data := map[string]interface{}{
+		"user":  &methodUser{"Ada", "Lovelace"},
+		"plain": methodUser{"Alan", "Turing"},
+		"users": []methodUser{{"Grace", "Hopper"}},
+		"tags":  methodTags{"a", "b"},
+	}
+	testFrag(t, data, `<v>.user.DisplayName</v>,<v>.user.Initials</v>,<v>.plain.Initials</v>,<if v=".plain.Active">active</if>`, `Ada Lovelace,AL,AT,active`)
+	testFrag(t, data, `<for v=".users"><v>.Initials</v></for>,<v>.tags.Count</v>,<v>.tags.0</v>`, `GH,2,a`)
+	testFrag(t, data, `<let var="u" val=".user"><v>u.DisplayName | upper</v></let>`, `ADA LOVELACE`)
+	testFrag(t, data, `<v>.plain.First</v>`, `Alan`)
+
+	// Fields and map keys take precedence over methods with the same name, so adding a method does not change existing paths
+	testFrag(t, map[string]interface{}{
+		"counts": methodCounts{"Total": 5},
+		"named":  methodNamed{methodMeta{"field"}},
+	}, `<v>.counts.Total</v>,<v>.named.Name</v>`, `5,field`)
+}
+
+type taggedMeta struct {
+	Note string `json:"note"`
+}
+type taggedUser struct {
+	taggedMeta
+	UserName string `json:"user_name,omitempty"`
+	Email    string `htmpl:"mail" json:"email"`
+	Password string `json:"-"`
+	Plain    string
+}
+
+// Struct fields should be named by their struct tags if StructTags is set
+func TestStructTags(t *testing.T) {
+	config := &Config{StructTags: true}
+	tmpl, err := config.Parse(strings.NewReader(`<v>.user_name</v>,<v>.mail</v>,<v>.note</v>,<v>.Plain</v>|<for v="." key="k"><v>k</v>=<v>.</v>;</for>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, taggedUser{taggedMeta{"n"}, "ada", "ada@example.com", "secret", "p"}); err != nil {
+		t.Error(err)
+	}
+	if expected := `ada,ada@example.com,n,p|note=n;user_name=ada;mail=ada@example.com;Plain=p;`; b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+
+	tmpl, err = config.Parse(strings.NewReader(`<v>.Password</v>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Evaluate(taggedUser{}); err == nil {
+		t.Error("Expected error for hidden field, received nil")
+	}
+
+	// Without StructTags, fields keep their Go names
+	testFrag(t, taggedUser{UserName: "ada"}, `<v>.UserName</v>`, `ada`)
+}
+
+type lookupCounter map[string]int
+
+func (c lookupCounter) Lookup(key string) (interface{}, bool) {
+	if n, ok := c[key]; ok {
+		return n * 2, true
+	}
+	return nil, false
+}
+
+// Values implementing Lookuper should control how they are indexed
+func TestLookuper(t *testing.T) {
+	data := map[string]interface{}{"c": lookupCounter{"a": 1}}
+	testFrag(t, data, `<v>.c.a</v>,<v>.c.b</v>,<v>.c[.k]</v>`, `2,,`)
+	testFrag(t, []lookupCounter{{"x": 2}}, `<for v="."><v>.x</v></for>`, `4`)
+}
+
+// <for> should iterate over numeric ranges
+func TestForRange(t *testing.T) {
+	testFrag(t, map[string]interface{}{"stars": 3, "pages": 4.0, "missing": nil}, `
+		<for to=".stars">*</for>|
+		<for from="0" to="10" step="3"><v>.</v>,</for>|
+		<for from="$.pages" to="1" step="-2" val="n"><v>loop.Number</v>/<v>loop.Length</v>:<v>n</v>,</for>|
+		<for from="5" to="1">x</for>|
+		<for to=".missing">x</for>|
+		<for from="2" to="2"><v>loop.First</v><v>loop.Last</v></for>
+	`, `***|0,3,6,9,|1/2:4,2/2:2,|||truetrue`)
+
+	// The length of a range should not overflow when its bounds are far apart
+	testFrag(t, map[string]int{"min": -math.MaxInt, "max": math.MaxInt, "step": 1 << 62},
+		`<for from=".min" to=".max" step=".step"><v>.</v>,</for>`,
+		`-9223372036854775807,-4611686018427387903,1,4611686018427387905,`)
+}
+
+// Maps should be iterated in the natural order of their keys if requested
+func TestSortMaps(t *testing.T) {
+	testFrag(t, map[string]interface{}{
+		"s": map[string]int{"b": 1, "a": 2, "B": 3, "ab": 4},
+		"i": map[int]bool{10: true, -2: true, 3: true, 0: true},
+		"f": map[float64]bool{2.5: true, -1: true, 10: true},
+		"x": map[interface{}]bool{"b": true, 2: true, false: true, 1.5: true, "a": true, true: true},
+	}, `
+		<for v=".s" sort><v>.</v>,</for>|
+		<for v=".i" sort><v>.</v>,</for>|
+		<for v=".f" sort><v>.</v>,</for>|
+		<for v=".x" sort><v>.</v>,</for>
+	`, `B,a,ab,b,|-2,0,3,10,|-1,2.5,10,|false,true,1.5,2,a,b,`)
+
+	config := &Config{SortMaps: true}
+	tmpl, err := config.Parse(strings.NewReader(`<for v="."><v>.</v>=<v>loop.Value</v>,</for>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, map[uint]string{3: "c", 1: "a", 2: "b"}); err != nil {
+		t.Error(err)
+	}
+	if expected := `1=a,2=b,3=c,`; b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+}
+
+// The loop variable should describe the current iteration of a <for> element
+func TestLoop(t *testing.T) {
+	testFrag(t, []string{"a", "b", "c"}, `
+		<for v=".">
+			<v>loop.Number</v>/<v>loop.Length</v>:<v>.</v>
+			<if v="loop.First">(first)</if>
+			<if v="not loop.Last">, </if>
+		</for>
+	`, `1/3:a(first), 2/3:b, 3/3:c`)
+	testFrag(t, map[string]interface{}{"outer": []int{1, 2}, "inner": []string{"x", "y"}}, `
+		<for v=".outer">
+			<let var="i" val="loop.Index">
+				<for v="$.inner">[<v>i</v><v>loop.Index</v>=<v>loop.Value</v>]</for>
+			</let>
+			<v>loop.Key</v>
+		</for>
+		<v>loop.Index</v>
+	`, `[00=x][01=y]0[10=x][11=y]1`)
+	testFrag(t, map[string]map[string]int{"m": {"a": 1}}, `
+		<for v=".m"><v>.</v>,<v>loop.Key</v>=<v>loop.Value</v>,<v>loop.Last</v></for>
+	`, `a,a=1,true`)
+	testFrag(t, struct{ A, B int }{1, 2}, `
+		<for v="."><v>loop.Key</v>=<v>loop.Value</v> </for>
+	`, `A=1 B=2 `)
+	testFrag(t, "x", `<for v="."><v>loop.Length</v><v>loop.Value</v></for>`, `1x`)
 }
 
 // <let> should bind variables within its body
@@ -290,3 +788,473 @@ func TestNoescape(t *testing.T) {
 		</div>
 	`)
 }
+
+// HTML substituted by <v noescape> should be sanitized by the template's policy
+func TestPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+	policy.Elements["div"] = []string{"class"}
+	config := &Config{Policy: policy}
+	tmpl, err := config.Parse(strings.NewReader(`<v noescape>.</v>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{`<b>bold</b> <i title="x" onclick="alert(1)">it</i>`, `<b>bold</b> <i title="x">it</i>`},
+		{`<script>alert(1)</script><style>*{}</style>ok`, `ok`},
+		{`<blink><u>kept</u></blink><!-- gone -->`, `<u>kept</u>`},
+		{`<a href="javascript:alert(1)">x</a><a href=" JaVaScRiPt:alert(1)">y</a>`, `<a>x</a><a>y</a>`},
+		{`<a href="/about" target="_blank">x</a><img src="https://example.com/a.png" alt="a">`, `<a href="/about">x</a><img src="https://example.com/a.png" alt="a"/>`},
+		{`<div class="c" id="d"><svg><a href="/x">y</a></svg></div>`, `<div class="c"></div>`},
+		{`<iframe src="/x"><p>fallback</p></iframe><p>after</p>`, `<p>after</p>`},
+		{HTML(`<script>trusted()</script>`), `<script>trusted()</script>`},
+		{html.Node{Type: html.ElementNode, DataAtom: atom.Script, Data: "script"}, `<script></script>`},
+	}
+	for _, test := range tests {
+		b := strings.Builder{}
+		if err := tmpl.Execute(&b, test.input); err != nil {
+			t.Error(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", test.expected, b.String())
+		}
+	}
+
+	// Without a policy, the HTML is not sanitized
+	testFrag(t, `<script>alert(1)</script>`, `<v noescape>.</v>`, `<script>alert(1)</script>`)
+}
+
+// Values of trusted types should bypass escaping in the contexts they are trusted in
+func TestTrusted(t *testing.T) {
+	testFrag(t, map[string]interface{}{
+		"html":  HTML("<b>bold</b>"),
+		"thtml": template.HTML("<i>it</i>"),
+		"url":   URL("javascript:go()"),
+		"turl":  template.URL("javascript:go()"),
+		"js":    JS("go(1)"),
+		"tjs":   template.JS("go(2)"),
+		"css":   CSS("expression(x)"),
+		"tcss":  template.CSS("red;"),
+	}, `
+		<p><v>.html</v>|<v>.thtml</v></p>
+		<a v:href=".url" v:title=".html"></a>
+		<a v:href=".turl"></a>
+		<button v:onclick=".js" v:style=".css"></button>
+		<button v:onclick=".tjs" v:style=".tcss"></button>
+		<script v>var a = <v>.js</v>, b = '<v>.js</v>', c = <v>.html</v>;</script>
+	`, `
+		<p><b>bold</b>|<i>it</i></p>
+		<a href="javascript:go%28%29" title="&lt;b&gt;bold&lt;/b&gt;"></a>
+		<a href="javascript:go%28%29"></a>
+		<button onclick="go(1)" style="expression(x)"></button>
+		<button onclick="go(2)" style="red;"></button>
+		<script>var a = go(1), b = 'go(1)', c = "\u003cb\u003ebold\u003c/b\u003e";</script>
+	`)
+	// Trusted HTML is not sanitized by a policy
+	tmpl, err := (&Config{Policy: DefaultPolicy()}).Parse(strings.NewReader(`<v noescape>.</v>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, template.HTML(`<script>ok()</script>`)); err != nil {
+		t.Error(err)
+	}
+	if expected := `<script>ok()</script>`; b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+}
+
+// Attributes should be preserved, and v: attributes should be substituted
+func TestAttr(t *testing.T) {
+	testFrag(t, nil, `
+		<a href="/about" class="nav">About</a>
+	`, `
+		<a href="/about" class="nav">About</a>
+	`)
+	testFrag(t, map[string]interface{}{
+		"link":  "/users?name=Bob Smith",
+		"class": `big "red"`,
+		"yes":   true,
+		"no":    false,
+	}, `
+		<a v:href=".link" v:class=".class" id="x">Bob</a>
+		<input type="checkbox" v:checked=".yes">
+		<input type="checkbox" v:checked=".no">
+		<input type="checkbox" v:checked=".missing">
+	`, `
+		<a href="/users?name=Bob%20Smith" class="big &#34;red&#34;" id="x">Bob</a>
+		<input type="checkbox" checked=""/>
+		<input type="checkbox"/>
+		<input type="checkbox"/>
+	`)
+	testFrag(t, []string{"javascript:alert(1)", "HTTPS://example.com/", "mailto:bob@example.com", "foo/bar:baz"}, `
+		<for v="."><a v:href="."></a></for>
+		<img v:src=".0">
+	`, `
+		<a href="#ZgotmplZ"></a>
+		<a href="HTTPS://example.com/"></a>
+		<a href="mailto:bob@example.com"></a>
+		<a href="foo/bar:baz"></a>
+		<img src="#ZgotmplZ"/>
+	`)
+	// The srcdoc attribute contains a document, which should only contain untrusted values as text
+	testFrag(t, map[string]interface{}{"doc": "<script>alert(1)</script>", "html": HTML("<b>hi</b>")}, `
+		<iframe v:srcdoc=".doc"></iframe>
+		<iframe v:srcdoc=".html"></iframe>
+	`, `
+		<iframe srcdoc="&amp;lt;script&amp;gt;alert(1)&amp;lt;/script&amp;gt;"></iframe>
+		<iframe srcdoc="&lt;b&gt;hi&lt;/b&gt;"></iframe>
+	`)
+}
+
+// Values should be escaped according to their context, as html/template does
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		ctx      Context
+		val      interface{}
+		expected string
+	}{
+		{ContextText, "<b>", "<b>"},
+		{ContextURL, "javascript:alert(1)", "#ZgotmplZ"},
+		{ContextURL, " JavaScript:alert(1)", "#ZgotmplZ"},
+		{ContextURL, "/search?q=a b&c", "/search?q=a%20b&c"},
+		{ContextJS, 42, " 42 "},
+		{ContextJS, "</script>", `"\u003c/script\u003e"`},
+		{ContextJS, []string{"a", "b"}, `["a","b"]`},
+		{ContextJS, map[string]int{"a": 1}, `{"a":1}`},
+		{ContextJS, nil, " null "},
+		{ContextJS, func() {}, " /* error */ null "},
+		{ContextJSString, `it's "quoted"`, `it\u0027s \u0022quoted\u0022`},
+		{ContextJSString, "</script>\n", `\u003c\/script\u003e\n`},
+		{ContextJSString, "${x}`", `\u0024{x}\u0060`},
+		{ContextJSString, "a\u2028b", `a\u2028b`},
+		{ContextJSRegexp, "a.b*", `a\.b\*`},
+		{ContextJSRegexp, "", "(?:)"},
+		{ContextCSS, "red", "red"},
+		{ContextCSS, "#fff", "#fff"},
+		{ContextCSS, "red; background: url(x)", "ZgotmplZ"},
+		{ContextCSS, "expression(alert(1))", "ZgotmplZ"},
+		{ContextCSS, "a--b", "ZgotmplZ"},
+		{ContextCSSString, `"</style>`, `\22\3c\2fstyle\3e `},
+		{ContextCSSString, "a\\b", `a\\b`},
+		{ContextCSSURL, "javascript:alert(1)", `#ZgotmplZ`},
+		{ContextCSSURL, "/img/a b.png", `\2fimg\2f a%20b.png`},
+		{ContextComment, "*/ alert(1) /*", ""},
+		{ContextHTML, "<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{ContextHTML, HTML("<b>bold</b>"), "<b>bold</b>"},
+	}
+	for _, test := range tests {
+		if actual := Escape(test.ctx, test.val); actual != test.expected {
+			t.Errorf("Escape(%d, %#v):\n\tExpected: %q\n\tReceived: %q", test.ctx, test.val, test.expected, actual)
+		}
+	}
+}
+
+// Values should be substituted into scripts, styles and their attributes with escaping
+func TestRawText(t *testing.T) {
+	testFrag(t, map[string]interface{}{
+		"name":  "</script><script>alert(1)",
+		"count": 3,
+		"color": "red",
+		"font":  "Comic Sans'",
+		"bad":   "red;}",
+	}, `
+		<script v>var name = <v>.name</v>, msg = 'Hi <v>.name</v>', n = <v>.count</v>/2;</script>
+		<style v>p { color: <v>.color</v>; font-family: '<v>.font</v>'; background: <v>.bad</v> }</style>
+		<button v:onclick=".name">Go</button>
+		<p v:style=".bad" v:data-style=".color"></p>
+	`, `
+		<script>var name = "\u003c/script\u003e\u003cscript\u003ealert(1)", msg = 'Hi \u003c\/script\u003e\u003cscript\u003ealert(1)', n =  3 /2;</script>
+		<style>p { color: red; font-family: 'Comic Sans\27 '; background: ZgotmplZ }</style>
+		<button onclick="&#34;\u003c/script\u003e\u003cscript\u003ealert(1)&#34;">Go</button>
+		<p style="ZgotmplZ" data-style="red"></p>
+	`)
+	// Without the v attribute, the content is static
+	testFrag(t, "x", `
+		<script type="module">var x = <v>.</v>;</script>
+		<script v type="module"></script>
+	`, `
+		<script type="module">var x = <v>.</v>;</script>
+		<script type="module"></script>
+	`)
+}
+
+// Templates should be reusable, including concurrently
+func TestTemplate(t *testing.T) {
+	tmpl, err := Parse(strings.NewReader(`<ul><for v="."><li v:id=".">Item <v>.</v></li></for></ul><p>Static</p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			nodes, err := tmpl.Evaluate([]int{i, i + 1})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b := strings.Builder{}
+			for _, node := range nodes {
+				html.Render(&b, node)
+			}
+			expected := fmt.Sprintf(`<ul><li id="%d">Item %[1]d</li><li id="%d">Item %[2]d</li></ul><p>Static</p>`, i, i+1)
+			if b.String() != expected {
+				t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err := Parse(strings.NewReader(`<if v=".[">x</if>`)); err == nil {
+		t.Error("Expected error for invalid path")
+	}
+}
+
+// Execute should render the same HTML as html.Render on the result of Evaluate
+func TestExecute(t *testing.T) {
+	dot := map[string]interface{}{
+		"x":     "a<b&c",
+		"nl":    "\nfoo",
+		"html":  "<i>x</i> &amp; y",
+		"nodes": []*html.Node{{Type: html.ElementNode, Data: "b"}, {Type: html.TextNode, Data: "\n<i>"}},
+	}
+	for _, src := range []string{
+		`<!DOCTYPE html><!-- comment --><p v:title=".x">'quoted' &amp; "double"</p>`,
+		`<pre v:class=".x">` + "\n\nfoo</pre>",
+		`<pre v:class=".x"><v>.nl</v></pre>`,
+		`<textarea v:class=".x"><v>.nl</v></textarea><pre><v>.x</v><v>.nl</v></pre>`,
+		`<script v:src=".x">if (a < b && c) {}</script><style v:media=".x">a > b {}</style>`,
+		`<div><br v:class=".x"><img src="a.png"><input v:value=".x"></div>`,
+		`<div v:id=".x"><v noescape>.nodes</v><v noescape>.html</v></div>`,
+		`<svg v:class=".x"><circle r="1"></circle></svg>`,
+	} {
+		tmpl, err := Parse(strings.NewReader(src))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		nodes, err := tmpl.Evaluate(dot)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		expected := strings.Builder{}
+		for _, node := range nodes {
+			html.Render(&expected, node)
+		}
+		b := strings.Builder{}
+		if err := tmpl.Execute(&b, dot); err != nil {
+			t.Error(err)
+		}
+		if b.String() != expected.String() {
+			t.Errorf("Rendered and streamed output do not match:\n\tRendered: %q\n\tStreamed: %q", expected.String(), b.String())
+		}
+	}
+}
+
+const benchTemplate = `
+<!DOCTYPE html>
+<html>
+	<head><title>Benchmark</title></head>
+	<body>
+		<header><h1>Hello, <v>.Name</v>!</h1><nav><a href="/">Home</a><a href="/about">About</a></nav></header>
+		<if v=".Items">
+			<ul>
+				<for v=".Items">
+					<li v:class=".Class"><a v:href=".Link"><v>.Title</v></a><if v=".New"><em>New!</em></if></li>
+				</for>
+			</ul>
+		</if>
+		<footer><p>Lorem ipsum dolor sit amet, consectetur adipiscing elit.</p></footer>
+	</body>
+</html>
+`
+
+type benchItem struct {
+	Class, Link, Title string
+	New                bool
+}
+
+func benchData() interface{} {
+	items := make([]benchItem, 100)
+	for i := range items {
+		items[i] = benchItem{"item", fmt.Sprintf("/items/%d", i), fmt.Sprintf("Item %d", i), i%3 == 0}
+	}
+	return struct {
+		Name  string
+		Items []benchItem
+	}{"world", items}
+}
+
+// BenchmarkEvaluate measures Evaluate, which compiles the template on every call
+func BenchmarkEvaluate(b *testing.B) {
+	node := &html.Node{Type: html.DocumentNode}
+	if err := htmlparse.Parse(node, []byte(benchTemplate)); err != nil {
+		b.Fatal(err)
+	}
+	data := benchData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Evaluate(node, data)
+	}
+}
+
+// BenchmarkTemplateEvaluate measures a template compiled once, rendering to nodes
+func BenchmarkTemplateEvaluate(b *testing.B) {
+	tmpl, err := Parse(strings.NewReader(benchTemplate))
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := benchData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tmpl.Evaluate(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTemplateExecute measures a template compiled once, streaming its output
+func BenchmarkTemplateExecute(b *testing.B) {
+	tmpl, err := Parse(strings.NewReader(benchTemplate))
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := benchData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tmpl.Execute(io.Discard, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// <include> should evaluate another template
+func TestInclude(t *testing.T) {
+	config := &Config{FS: fstest.MapFS{
+		"page.html":            {Data: []byte(`<include src="partials/nav.html" dot=".User"></include><main><v>.Title</v></main><include src="partials/footer.html"></include>`)},
+		"partials/nav.html":    {Data: []byte(`<nav>Hello, <v>.Name</v><include src="partials/icon.html"></include></nav>`)},
+		"partials/icon.html":   {Data: []byte(`<img v:alt="$.Name">`)},
+		"partials/footer.html": {Data: []byte(`<footer><v>.Title</v></footer>`)},
+		"cycle.html":           {Data: []byte(`<include src="cycle2.html"></include>`)},
+		"cycle2.html":          {Data: []byte(`<if v=".">x<include src="cycle.html"></include></if>`)},
+		"bad.html":             {Data: []byte(`<p>` + "\n" + `<v>.Missing</v></p>`)},
+		"includes-bad.html":    {Data: []byte(`<include src="bad.html"></include>`)},
+	}}
+
+	type user struct{ Name string }
+	tmpl, err := config.ParseFile("page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, map[string]interface{}{"Title": "Home", "User": user{"Bob"}}); err != nil {
+		t.Error(err)
+	}
+	expected := `<nav>Hello, Bob<img alt="Bob"/></nav><main>Home</main><footer>Home</footer>`
+	if b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+
+	if tmpl2, _ := config.ParseFile("page.html"); tmpl2 != tmpl {
+		t.Error("Expected cached template")
+	}
+
+	for name, expected := range map[string]string{
+		"cycle.html":   `cycle2.html:1:12: <include> attribute "src": template "cycle.html" includes itself`,
+		"missing.html": `open missing.html: file does not exist`,
+	} {
+		if _, err := config.ParseFile(name); err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q, received %v", expected, err)
+		}
+	}
+
+	tmpl, err = config.ParseFile("includes-bad.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedErr := `bad.html:2:1: <v> path ".Missing": no field "Missing" in type htmpl.user`
+	if err := tmpl.Execute(io.Discard, user{}); err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q, received %v", expectedErr, err)
+	}
+
+	if _, err := Parse(strings.NewReader(`<include src="page.html"></include>`)); err == nil {
+		t.Error("Expected error when including without a file system")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	config := &Config{FS: fstest.MapFS{
+		"base.html":      {Data: []byte(`<h1><block name="title">Site</block></h1><main><block name="content">No content</block></main><footer><block name="footer">Footer</block></footer>`)},
+		"section.html":   {Data: []byte(`<extends src="base.html"><block name="title">Section</block><block name="content"><nav>Nav</nav><block name="body"></block></block></extends>`)},
+		"page.html":      {Data: []byte(`<extends src="section.html"><block name="title"><v>.Title</v></block><block name="body"><p><v>.Body</v></p></block></extends>`)},
+		"undefined.html": {Data: []byte(`<extends src="base.html">` + "\n" + `<block name="sidebar"></block></extends>`)},
+		"invalid.html":   {Data: []byte(`<extends src="base.html"><p>x</p></extends>`)},
+		"cycle.html":     {Data: []byte(`<extends src="cycle.html"></extends>`)},
+	}}
+
+	tmpl, err := config.ParseFile("page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, map[string]interface{}{"Title": "Hello", "Body": "World"}); err != nil {
+		t.Error(err)
+	}
+	expected := `<h1>Hello</h1><main><nav>Nav</nav><p>World</p></main><footer>Footer</footer>`
+	if b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+
+	for name, expected := range map[string]string{
+		"undefined.html": `undefined.html:2:1: <block> attribute "name": block "sidebar" is not defined in "base.html"`,
+		"invalid.html":   `invalid.html:1:26: <p>: <extends> may only contain <block> elements`,
+		"cycle.html":     `cycle.html:1:1: <extends> attribute "src": template "cycle.html" includes itself`,
+	} {
+		if _, err := config.ParseFile(name); err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q, received %v", expected, err)
+		}
+	}
+}
+
+func TestComponent(t *testing.T) {
+	testFrag(t, map[string]string{"Title": "Hello", "Body": "World"}, `<define name="card"><div class="card"><h2><v>title</v></h2><slot>Empty</slot></div></define><card v:title=".Title"><p><v>.Body</v></p></card><card v:title=".Body"> </card>`, `<div class="card"><h2>Hello</h2><p>World</p></div><div class="card"><h2>World</h2>Empty</div>`)
+	// Named slots
+	testFrag(t, nil, `<define name="page"><header><slot name="header"></slot></header><main><slot></slot></main></define><page><h1 slot="header">Title</h1><p>Body</p></page>`, `<header><h1 slot="header">Title</h1></header><main><p>Body</p></main>`)
+	// Slot content is evaluated in the caller's scope
+	testFrag(t, map[string]string{"A": "a", "B": "b"}, `<define name="item"><li><v>x</v>: <slot></slot></li></define><let var="x" val=".A"><item v:x=".B"><v>x</v></item></let>`, `<li>b: a</li>`)
+	// Components may use other components, and fill their slots with their own
+	testFrag(t, []int{1, 2}, `<define name="outer"><section><inner><slot></slot></inner></section></define><define name="inner"><div><slot></slot></div></define><outer><for v="."><v>.</v></for></outer>`, `<section><div>12</div></section>`)
+	// Recursion
+	testFrag(t, treeNode{"a", []treeNode{{"b", nil}, {"c", []treeNode{{"d", nil}}}}}, `<define name="tree"><v>.Name</v><if v=".Children"><ul><for v=".Children"><li><tree></tree></li></for></ul></if></define><tree></tree>`, `a<ul><li>b</li><li>c<ul><li>d</li></ul></li></ul>`)
+	// Attributes without a "v:" prefix bind their values as strings
+	testFrag(t, map[string]string{"Title": "Hello"}, `<define name="card"><div v:class="class"><v>title</v></div></define><card class="wide" v:title=".Title"></card><card class=".Title" title="x"></card>`, `<div class="wide">Hello</div><div class=".Title">x</div>`)
+	// Attributes may bind variables whose names are not Go identifiers
+	testFrag(t, map[string]string{"Kind": "new"}, `<define name="badge"><b><v>data-x</v></b></define><badge v:data-x=".Kind"></badge>`, `<b>new</b>`)
+	// Components defined by included templates are available to the including template
+	config := &Config{FS: fstest.MapFS{
+		"components.html": {Data: []byte(`<define name="greeting"><p>Hello, <v>name</v></p></define>`)},
+		"page.html":       {Data: []byte(`<include src="components.html"></include><greeting v:name=".Name"></greeting>`)},
+	}}
+	tmpl, err := config.ParseFile("page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, map[string]string{"Name": "Bob"}); err != nil {
+		t.Error(err)
+	}
+	if expected := `<p>Hello, Bob</p>`; b.String() != expected {
+		t.Errorf("Expected and actual output do not match:\n\tExpected: %q\n\tReceived: %q", expected, b.String())
+	}
+}
+
+type treeNode struct {
+	Name     string
+	Children []treeNode
+}
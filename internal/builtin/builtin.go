@@ -0,0 +1,60 @@
+// Package builtin implements the built-in functions that are shared by htmpl and the code generated by its gen package.
+package builtin
+
+import (
+	"math"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Title converts the first letter of each word to title case.
+func Title(s string) string {
+	r := []rune(s)
+	for i := range r {
+		if i == 0 || unicode.IsSpace(r[i-1]) {
+			r[i] = unicode.ToTitle(r[i])
+		}
+	}
+	return string(r)
+}
+
+// Truncate shortens a string to at most n characters, followed by an ellipsis if any were removed.
+func Truncate(s string, n int) string {
+	if n < 0 {
+		n = 0
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
+
+// SliceBounds returns the bounds used by the slice function for a string or array of length n.
+// The indices are clamped to the range [0, n], with the end no earlier than the start. If j is omitted, the end is n.
+func SliceBounds(n, i int, j ...int) (start, end int) {
+	start, end = i, n
+	if len(j) > 0 {
+		end = j[0]
+	}
+	start = min(max(start, 0), n)
+	end = min(max(end, start), n)
+	return start, end
+}
+
+// RangeLength returns the number of integers from from to to inclusive, counting in steps of step, as iterated by <for> elements.
+// If step is zero, the range is empty. Ranges of more than math.MaxInt integers are truncated to that length.
+func RangeLength(from, to, step int) int {
+	if step == 0 || step > 0 && to < from || step < 0 && to > from {
+		return 0
+	}
+	// The difference is computed in uint64, where it cannot overflow
+	diff, s := uint64(to)-uint64(from), uint64(step)
+	if step < 0 {
+		diff, s = -diff, -s
+	}
+	n := diff / s
+	if n >= math.MaxInt {
+		return math.MaxInt
+	}
+	return int(n) + 1
+}
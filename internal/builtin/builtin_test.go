@@ -0,0 +1,29 @@
+package builtin
+
+import (
+	"math"
+	"testing"
+)
+
+// The length of a range should be computed without overflowing, even when the bounds are far apart
+func TestRangeLength(t *testing.T) {
+	tests := []struct {
+		from, to, step, expected int
+	}{
+		{1, 5, 1, 5},
+		{0, 10, 3, 4},
+		{5, 1, -2, 3},
+		{1, 0, 1, 0},
+		{0, 1, -1, 0},
+		{0, 1, 0, 0},
+		{-math.MaxInt, math.MaxInt, 1 << 62, 4},
+		{math.MaxInt, math.MinInt, -(1 << 62), 4},
+		{math.MinInt, math.MaxInt, math.MaxInt, 3},
+		{math.MinInt, math.MaxInt, 1, math.MaxInt},
+	}
+	for _, test := range tests {
+		if actual := RangeLength(test.from, test.to, test.step); actual != test.expected {
+			t.Errorf("RangeLength(%d, %d, %d): expected %d, received %d", test.from, test.to, test.step, test.expected, actual)
+		}
+	}
+}
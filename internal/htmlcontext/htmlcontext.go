@@ -0,0 +1,300 @@
+// Package htmlcontext determines the contexts of values substituted into HTML documents, which are shared by htmpl and its generator.
+package htmlcontext
+
+import (
+	"errors"
+	"strings"
+)
+
+// A Context is the part of an HTML document that a value is substituted into, which determines how it is escaped.
+// The contexts are documented by the constants of htmpl, which are aliases of these.
+type Context uint8
+
+const (
+	Text Context = iota
+	URL
+	JS
+	JSString
+	JSRegexp
+	CSS
+	CSSString
+	CSSURL
+	Comment
+	HTML
+)
+
+// A TextPart is part of the content of a <script> or <style> element
+type TextPart struct {
+	Text    string  // Static text, if Path is empty
+	Path    string  // The expression contained in a <v> element
+	Context Context // The context of the expression
+}
+
+var errUnclosedV = errors.New("<v> must be closed by </v>")
+
+// Split splits the content of a <script> or <style> element into static text and <v> elements.
+// The content of these elements is not parsed as HTML, so <v> elements are recognised within the text,
+// and the context of each is determined from the JavaScript or CSS preceding it.
+func Split(element, text string) ([]TextPart, error) {
+	var s scanner = &cssScanner{}
+	if strings.ToLower(element) == "script" {
+		s = &jsScanner{regexp: true}
+	}
+
+	var parts []TextPart
+	for {
+		start := strings.Index(text, "<v>")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start:], "</v>")
+		if end < 0 {
+			return nil, errUnclosedV
+		}
+		end += start
+
+		if start > 0 {
+			parts = append(parts, TextPart{Text: text[:start]})
+			s.scan(text[:start])
+		}
+		path := strings.TrimSpace(text[start+len("<v>") : end])
+		if path == "" {
+			return nil, errors.New("<v> must contain a variable path")
+		}
+		parts = append(parts, TextPart{Path: path, Context: s.value()})
+		text = text[end+len("</v>"):]
+	}
+	if text != "" {
+		parts = append(parts, TextPart{Text: text})
+	}
+	return parts, nil
+}
+
+// A scanner tracks the state of JavaScript or CSS text, to determine the context of values substituted into it
+type scanner interface {
+	// scan advances the state past some static text
+	scan(text string)
+	// value returns the context of a value at the current position, and advances the state past it
+	value() Context
+}
+
+type jsMode uint8
+
+const (
+	jsCode jsMode = iota
+	jsSingleQuote
+	jsDoubleQuote
+	jsTemplate
+	jsRegexp
+	jsLineComment
+	jsBlockComment
+)
+
+// jsScanner tracks the state of JavaScript text
+type jsScanner struct {
+	mode   jsMode
+	regexp bool  // In code, whether a '/' would begin a regular expression rather than a division
+	class  bool  // In a regular expression, whether the scanner is within a character class
+	depth  int   // The number of unclosed braces in code
+	subs   []int // The brace depth at which each enclosing template literal substitution began
+}
+
+// regexpPrecederKeywords are the keywords after which a '/' begins a regular expression
+var regexpPrecederKeywords = map[string]bool{
+	"break":      true,
+	"case":       true,
+	"continue":   true,
+	"delete":     true,
+	"do":         true,
+	"else":       true,
+	"finally":    true,
+	"in":         true,
+	"instanceof": true,
+	"return":     true,
+	"throw":      true,
+	"try":        true,
+	"typeof":     true,
+	"void":       true,
+}
+
+func (s *jsScanner) scan(text string) {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch s.mode {
+		case jsCode:
+			switch {
+			case c == '\'':
+				s.mode = jsSingleQuote
+			case c == '"':
+				s.mode = jsDoubleQuote
+			case c == '`':
+				s.mode = jsTemplate
+			case c == '/' && strings.HasPrefix(text[i+1:], "/"):
+				s.mode = jsLineComment
+				i++
+			case c == '/' && strings.HasPrefix(text[i+1:], "*"):
+				s.mode = jsBlockComment
+				i++
+			case c == '/' && s.regexp:
+				s.mode, s.class = jsRegexp, false
+			case c == '{':
+				s.depth++
+				s.regexp = true
+			case c == '}':
+				if n := len(s.subs); n > 0 && s.subs[n-1] == s.depth {
+					s.subs = s.subs[:n-1]
+					s.mode = jsTemplate
+				} else {
+					s.depth--
+					s.regexp = true
+				}
+			case c == ')' || c == ']':
+				s.regexp = false
+			case c == '+' || c == '-':
+				// ++ and -- are postfix operators, after which '/' is a division, but + and - are not
+				run := 1
+				for run <= i && text[i-run] == c {
+					run++
+				}
+				s.regexp = run%2 == 1
+			case IsJSIdentPart(c):
+				j := i + 1
+				for j < len(text) && IsJSIdentPart(text[j]) {
+					j++
+				}
+				s.regexp = regexpPrecederKeywords[text[i:j]]
+				i = j - 1
+			case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			default:
+				s.regexp = true
+			}
+
+		case jsSingleQuote, jsDoubleQuote:
+			if c == '\\' {
+				i++
+			} else if c == '\'' && s.mode == jsSingleQuote || c == '"' && s.mode == jsDoubleQuote {
+				s.mode, s.regexp = jsCode, false
+			}
+
+		case jsTemplate:
+			if c == '\\' {
+				i++
+			} else if c == '`' {
+				s.mode, s.regexp = jsCode, false
+			} else if c == '$' && strings.HasPrefix(text[i+1:], "{") {
+				s.subs = append(s.subs, s.depth)
+				s.mode, s.regexp = jsCode, true
+				i++
+			}
+
+		case jsRegexp:
+			switch {
+			case c == '\\':
+				i++
+			case c == '[':
+				s.class = true
+			case c == ']':
+				s.class = false
+			case c == '/' && !s.class:
+				s.mode, s.regexp = jsCode, false
+			}
+
+		case jsLineComment:
+			if c == '\n' || c == '\r' {
+				s.mode = jsCode
+			}
+
+		case jsBlockComment:
+			if c == '*' && strings.HasPrefix(text[i+1:], "/") {
+				s.mode = jsCode
+				i++
+			}
+		}
+	}
+}
+
+func (s *jsScanner) value() Context {
+	switch s.mode {
+	case jsCode:
+		// A value is an operand, after which '/' is a division
+		s.regexp = false
+		return JS
+	case jsSingleQuote, jsDoubleQuote, jsTemplate:
+		return JSString
+	case jsRegexp:
+		return JSRegexp
+	default:
+		return Comment
+	}
+}
+
+// IsJSIdentPart returns true if c may be part of a JavaScript identifier or number.
+// Bytes of multi-byte characters are included, as most non-ASCII characters are identifier characters.
+func IsJSIdentPart(c byte) bool {
+	return c == '$' || c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
+
+type cssMode uint8
+
+const (
+	cssCode cssMode = iota
+	cssSingleQuote
+	cssDoubleQuote
+	cssComment
+)
+
+// cssScanner tracks the state of CSS text
+type cssScanner struct {
+	mode cssMode
+	url  bool // Whether the scanner is within url(...)
+}
+
+func (s *cssScanner) scan(text string) {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch s.mode {
+		case cssCode:
+			switch {
+			case c == '\\':
+				i++
+			case c == '\'':
+				s.mode = cssSingleQuote
+			case c == '"':
+				s.mode = cssDoubleQuote
+			case c == '/' && strings.HasPrefix(text[i+1:], "*"):
+				s.mode = cssComment
+				i++
+			case c == '(':
+				s.url = i >= 3 && strings.EqualFold(text[i-3:i], "url")
+			case c == ')':
+				s.url = false
+			}
+
+		case cssSingleQuote, cssDoubleQuote:
+			if c == '\\' {
+				i++
+			} else if c == '\'' && s.mode == cssSingleQuote || c == '"' && s.mode == cssDoubleQuote {
+				s.mode = cssCode
+			}
+
+		case cssComment:
+			if c == '*' && strings.HasPrefix(text[i+1:], "/") {
+				s.mode = cssCode
+				i++
+			}
+		}
+	}
+}
+
+func (s *cssScanner) value() Context {
+	switch {
+	case s.mode == cssComment:
+		return Comment
+	case s.url:
+		return CSSURL
+	case s.mode == cssCode:
+		return CSS
+	default:
+		return CSSString
+	}
+}
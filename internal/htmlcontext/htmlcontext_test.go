@@ -0,0 +1,49 @@
+package htmlcontext
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The context of values in <script v> and <style v> elements should be determined from the preceding code
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		element, text string
+		expected      []Context
+	}{
+		{"script", "var x = <v>.</v>;", []Context{JS}},
+		{"script", "var x = '<v>.</v>', y = \"<v>.</v>\";", []Context{JSString, JSString}},
+		{"script", "var x = '\\'<v>.</v>';", []Context{JSString}},
+		{"script", "`a ${<v>.</v>} b <v>.</v>`; <v>.</v>", []Context{JS, JSString, JS}},
+		{"script", "`${{a: 1}.a} <v>.</v>`", []Context{JSString}},
+		{"script", "var re = /<v>.</v>/;", []Context{JSRegexp}},
+		{"script", "var re = /[/]<v>.</v>/;", []Context{JSRegexp}},
+		{"script", "x = a / <v>.</v> / 2", []Context{JS}},
+		{"script", "x = (a) / <v>.</v>", []Context{JS}},
+		{"script", "x = <v>.</v> / 2; return /<v>.</v>/", []Context{JS, JSRegexp}},
+		{"script", "x++ / <v>.</v>", []Context{JS}},
+		{"script", "x = + /<v>.</v>/", []Context{JSRegexp}},
+		{"script", "// <v>.</v>\n<v>.</v>", []Context{Comment, JS}},
+		{"script", "/* <v>.</v> */ <v>.</v>", []Context{Comment, JS}},
+		{"style", "p { color: <v>.</v> }", []Context{CSS}},
+		{"style", "p { font-family: '<v>.</v>', \"<v>.</v>\" }", []Context{CSSString, CSSString}},
+		{"style", "p { background: url(<v>.</v>) url('<v>.</v>') <v>.</v> }", []Context{CSSURL, CSSURL, CSS}},
+		{"style", "/* <v>.</v> */ p { color: <v>.</v> }", []Context{Comment, CSS}},
+	}
+	for _, test := range tests {
+		parts, err := Split(test.element, test.text)
+		if err != nil {
+			t.Errorf("Split(%q, %q): %v", test.element, test.text, err)
+			continue
+		}
+		var actual []Context
+		for _, part := range parts {
+			if part.Path != "" {
+				actual = append(actual, part.Context)
+			}
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+			t.Errorf("Split(%q, %q):\n\tExpected: %v\n\tReceived: %v", test.element, test.text, test.expected, actual)
+		}
+	}
+}
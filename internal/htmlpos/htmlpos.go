@@ -0,0 +1,113 @@
+// Package htmlpos finds the positions of nodes in the source of templates, for the errors reported by htmpl and its generator.
+package htmlpos
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// A Position is the line and column of a node in the source of a template, which are 1-based
+type Position struct {
+	Line, Col int
+}
+
+// Locate finds the position of each element, comment and doctype node in a tree parsed from src by htmlparse.
+// htmlparse does not restructure the document, so nodes appear in the tree in the same order as in the source.
+func Locate(src []byte, root *html.Node) map[*html.Node]Position {
+	l := locator{src: src, pos: make(map[*html.Node]Position)}
+	l.locate(root)
+	return l.pos
+}
+
+type locator struct {
+	src     []byte
+	off     int
+	line    int // Number of newlines before lineOff
+	lineOff int // Offset of the start of the current line
+	pos     map[*html.Node]Position
+	scanned int // Offset up to which newlines have been counted
+}
+
+func (l *locator) locate(node *html.Node) {
+	switch node.Type {
+	case html.ElementNode:
+		if l.find(node.Data) {
+			l.pos[node] = l.position()
+			l.skipTag()
+		}
+		switch node.Data {
+		case "script", "style", "textarea", "title":
+			// Raw text may contain things that look like tags, so skip to the closing tag
+			l.find("/" + node.Data)
+			return
+		}
+
+	case html.CommentNode, html.DoctypeNode:
+		if l.find("!") {
+			l.pos[node] = l.position()
+			end := []byte(">")
+			if bytes.HasPrefix(l.src[l.off:], []byte("<!--")) {
+				end = []byte("-->")
+			}
+			if idx := bytes.Index(l.src[l.off:], end); idx >= 0 {
+				l.off += idx + len(end)
+			} else {
+				l.off = len(l.src)
+			}
+		}
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		l.locate(child)
+	}
+}
+
+// find advances to the next '<' followed by the given name, case-insensitively
+func (l *locator) find(name string) bool {
+	for {
+		idx := bytes.IndexByte(l.src[l.off:], '<')
+		if idx < 0 {
+			return false
+		}
+		l.off += idx
+		rest := l.src[l.off+1:]
+		if len(rest) >= len(name) && strings.EqualFold(string(rest[:len(name)]), name) {
+			if name == "!" || len(rest) == len(name) || bytes.IndexByte([]byte(" \t\r\n\f/>"), rest[len(name)]) >= 0 {
+				return true
+			}
+		}
+		l.off++
+	}
+}
+
+// skipTag advances past the end of the tag at the current offset, ignoring any '>' in quoted attribute values
+func (l *locator) skipTag() {
+	var quote byte
+	for ; l.off < len(l.src); l.off++ {
+		c := l.src[l.off]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			l.off++
+			return
+		}
+	}
+}
+
+// position computes the line and column of the current offset
+func (l *locator) position() Position {
+	for ; l.scanned < l.off; l.scanned++ {
+		if l.src[l.scanned] == '\n' {
+			l.line++
+			l.lineOff = l.scanned + 1
+		}
+	}
+	return Position{l.line + 1, l.off - l.lineOff + 1}
+}
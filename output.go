@@ -0,0 +1,230 @@
+package htmpl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// An output receives the nodes produced by evaluating a template
+type output interface {
+	// static outputs a copy of a static node
+	static(in *staticInstr)
+	// text outputs a text node
+	text(s string)
+	// node outputs a copy of an arbitrary node
+	node(n *html.Node)
+	// open outputs an element, and directs subsequent output into it until close is called
+	open(node *html.Node, attrs []html.Attribute)
+	close()
+}
+
+// treeOutput constructs a tree of nodes
+type treeOutput struct {
+	root   *html.Node
+	parent *html.Node
+}
+
+func newTreeOutput() *treeOutput {
+	root := &html.Node{Type: html.DocumentNode}
+	return &treeOutput{root, root}
+}
+
+// nodes detaches and returns the top-level nodes
+func (out *treeOutput) nodes() (nodes []*html.Node) {
+	for child := out.root.FirstChild; child != nil; {
+		next := child.NextSibling
+		out.root.RemoveChild(child)
+		nodes = append(nodes, child)
+		child = next
+	}
+	return
+}
+
+func (out *treeOutput) static(in *staticInstr) {
+	out.parent.AppendChild(deepClone(in.node))
+}
+func (out *treeOutput) text(s string) {
+	out.parent.AppendChild(&html.Node{Type: html.TextNode, Data: s})
+}
+func (out *treeOutput) node(n *html.Node) {
+	out.parent.AppendChild(deepClone(n))
+}
+func (out *treeOutput) open(node *html.Node, attrs []html.Attribute) {
+	n := shallowClone(node)
+	n.Attr = attrs
+	out.parent.AppendChild(n)
+	out.parent = n
+}
+func (out *treeOutput) close() {
+	out.parent = out.parent.Parent
+}
+
+// writerOutput renders nodes directly to a writer.
+// The output is identical to that of html.Render on the equivalent tree.
+type writerOutput struct {
+	w   *bufio.Writer
+	err error
+
+	stack []string // The names of the open elements
+	empty bool     // Whether the innermost open element has no children yet
+	done  bool     // Whether a <plaintext> element has been closed, after which nothing more is rendered
+}
+
+func newWriterOutput(w io.Writer) *writerOutput {
+	return &writerOutput{w: bufio.NewWriter(w)}
+}
+
+func (out *writerOutput) flush() error {
+	if out.err != nil {
+		return out.err
+	}
+	return out.w.Flush()
+}
+
+func (out *writerOutput) write(s string) {
+	if out.err == nil && !out.done {
+		_, out.err = out.w.WriteString(s)
+	}
+}
+
+// child must be called before each node is output.
+// If the node is a text node, its text is used to handle newlines at the start of <pre> elements.
+func (out *writerOutput) child(isText bool, text string) {
+	if len(out.stack) == 0 {
+		return
+	}
+	parent := out.stack[len(out.stack)-1]
+	if voidElements[parent] && out.err == nil {
+		out.err = fmt.Errorf("html: void element <%s> has child nodes", parent)
+	}
+	if out.empty && isText && strings.HasPrefix(text, "\n") {
+		switch parent {
+		case "pre", "listing", "textarea":
+			// Add initial newline where there is danger of a newline being ignored
+			out.write("\n")
+		}
+	}
+	out.empty = false
+}
+
+// raw returns true if text nodes are currently rendered without escaping
+func (out *writerOutput) raw() bool {
+	if len(out.stack) == 0 {
+		return false
+	}
+	switch out.stack[len(out.stack)-1] {
+	case "iframe", "noembed", "noframes", "noscript", "plaintext", "script", "style", "xmp":
+		return true
+	}
+	return false
+}
+
+func (out *writerOutput) static(in *staticInstr) {
+	if in.node.Type == html.TextNode {
+		out.text(in.node.Data)
+		return
+	}
+	out.child(false, "")
+	if in.err != nil && out.err == nil {
+		out.err = in.err
+	}
+	out.write(in.html)
+	if in.plaintext {
+		out.done = true
+	}
+}
+func (out *writerOutput) text(s string) {
+	out.child(true, s)
+	if out.raw() {
+		out.write(s)
+	} else {
+		out.write(html.EscapeString(s))
+	}
+}
+func (out *writerOutput) node(n *html.Node) {
+	if n.Type == html.TextNode {
+		out.text(n.Data)
+		return
+	}
+	out.child(false, "")
+	b := strings.Builder{}
+	if err := html.Render(&b, n); err != nil && out.err == nil {
+		out.err = err
+	}
+	out.write(b.String())
+	if containsPlaintext(n) {
+		out.done = true
+	}
+}
+func (out *writerOutput) open(node *html.Node, attrs []html.Attribute) {
+	out.child(false, "")
+	out.write("<")
+	out.write(node.Data)
+	for _, attr := range attrs {
+		out.write(" ")
+		if attr.Namespace != "" {
+			out.write(attr.Namespace)
+			out.write(":")
+		}
+		out.write(attr.Key)
+		out.write(`="`)
+		out.write(html.EscapeString(attr.Val))
+		out.write(`"`)
+	}
+	if voidElements[node.Data] {
+		out.write("/>")
+	} else {
+		out.write(">")
+	}
+	out.stack = append(out.stack, node.Data)
+	out.empty = true
+}
+func (out *writerOutput) close() {
+	name := out.stack[len(out.stack)-1]
+	out.stack = out.stack[:len(out.stack)-1]
+	out.empty = false
+	if name == "plaintext" {
+		// <plaintext> has no closing tag
+		out.done = true
+	} else if !voidElements[name] {
+		out.write("</")
+		out.write(name)
+		out.write(">")
+	}
+}
+
+// containsPlaintext returns true if a tree contains a <plaintext> element, after which html.Render stops rendering
+func containsPlaintext(node *html.Node) bool {
+	if node.Type == html.ElementNode && node.Data == "plaintext" {
+		return true
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if containsPlaintext(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// voidElements is the set of elements which cannot have children, as defined by html.Render
+var voidElements = map[string]bool{
+	"area":   true,
+	"base":   true,
+	"br":     true,
+	"col":    true,
+	"embed":  true,
+	"hr":     true,
+	"img":    true,
+	"input":  true,
+	"keygen": true,
+	"link":   true,
+	"meta":   true,
+	"param":  true,
+	"source": true,
+	"track":  true,
+	"wbr":    true,
+}
@@ -0,0 +1,662 @@
+package htmpl_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vktec/htmpl"
+)
+
+// knownDivergences are the cases in which generated code is known to differ from htmpl.Evaluate, or cannot be generated,
+// and the reasons for the differences. Cases are named by their test and their index within it.
+var knownDivergences = map[string]string{
+	"TestV#3":        "the slice used for keys has elements of different types, which cannot be declared in Go code",
+	"TestBuiltins#5": "the default has a different type to the value, which generated code cannot substitute",
+	"TestBuiltins#7": "the first item of an empty slice is the zero value of its type, rather than empty",
+	"TestEmbedded#3": "fields promoted through nil embedded pointers are the zero values of their types, rather than empty",
+	"TestLookuper#0": "htmpl.Lookuper is not supported in generated code",
+	"TestLookuper#1": "htmpl.Lookuper is not supported in generated code",
+}
+
+// Generated code should produce the same output as htmpl.Evaluate for every case checked by testFrag in the tests that have run.
+// Each case is generated with a concrete type for dot, and all cases are compiled and run together in a temporary module.
+// The module uses this repository and the module cache, so the test runs offline.
+// Generating and compiling the code is slow, so the test is skipped in short mode.
+func TestParity(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generating and compiling code is slow")
+	}
+	cases := htmpl.FragCases()
+	if len(cases) == 0 {
+		t.Skip("no tests using testFrag have run")
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := writeModule(root, dir); err != nil {
+		t.Fatal(err)
+	}
+	methods, err := testMethods(filepath.Join(root, "htmpl_test.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Declare the type and value of dot for each case.
+	// Cases that cannot be expressed in Go code or cannot be generated are recorded as failures.
+	failures := map[string]string{}
+	w := &goWriter{imports: map[string]bool{}, named: map[reflect.Type]string{}, names: map[string]bool{"ptr": true, "render": true}, methods: methods}
+	dots := strings.Builder{}
+	var jobs []generateJob
+	var generate []int
+	for i, c := range cases {
+		code, typ, err := "nil", "*struct{}", error(nil)
+		w.tags = false
+		if c.Dot != nil {
+			code, typ, err = w.concrete(reflect.ValueOf(c.Dot))
+		}
+		if err != nil {
+			failures[c.Name] = err.Error()
+			continue
+		}
+		// Aliases are used, so the generated code sees the same types as htmpl.Evaluate
+		fmt.Fprintf(&dots, "type dot%d = %s\nvar dotValue%d dot%d = %s\n", i, typ, i, i, code)
+		jobs = append(jobs, generateJob{fmt.Sprintf("case%d.go", i), fmt.Sprintf("evaluate%d", i), fmt.Sprintf("dot%d", i), c.Input, w.tags})
+		generate = append(generate, i)
+	}
+	src := strings.Builder{}
+	src.WriteString("package main\n\nimport (\n")
+	for _, path := range sortedKeys(w.imports) {
+		fmt.Fprintf(&src, "\t%q\n", path)
+	}
+	src.WriteString(")\n\nfunc ptr[T any](v T) *T { return &v }\n\n")
+	src.WriteString(w.decls.String())
+	src.WriteString(dots.String())
+	if err := os.WriteFile(filepath.Join(dir, "dots.go"), []byte(src.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Generate the code for each case in a subprocess, as the generator loads the package in the current directory
+	if err := os.Mkdir(filepath.Join(dir, "generate"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "generate", "main.go"), []byte(generateMain), 0666); err != nil {
+		t.Fatal(err)
+	}
+	input, err := json.Marshal(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := goCommand(dir, "run", "./generate")
+	cmd.Stdin = bytes.NewReader(input)
+	var errs []string
+	runJSON(t, cmd, &errs)
+	var generated []int
+	for j, i := range generate {
+		if errs[j] != "" {
+			failures[cases[i].Name] = "generating code: " + errs[j]
+			continue
+		}
+		generated = append(generated, i)
+	}
+
+	main := strings.Builder{}
+	main.WriteString(`package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// render renders the output of generated code, reporting panics as output
+func render(evaluate func() []*html.Node) (out string) {
+	defer func() {
+		if r := recover(); r != nil {
+			out = fmt.Sprint("panic: ", r)
+		}
+	}()
+	b := strings.Builder{}
+	for _, node := range evaluate() {
+		html.Render(&b, node)
+	}
+	return b.String()
+}
+
+func main() {
+	json.NewEncoder(os.Stdout).Encode([]string{
+`)
+	for _, i := range generated {
+		fmt.Fprintf(&main, "\t\trender(func() []*html.Node { return evaluate%d(dotValue%d) }),\n", i, i)
+	}
+	main.WriteString("\t})\n}\n")
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(main.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var outputs []string
+	runJSON(t, goCommand(dir, "run", "."), &outputs)
+	generatedOutputs := map[string]string{}
+	for j, i := range generated {
+		generatedOutputs[cases[i].Name] = outputs[j]
+	}
+
+	names := map[string]bool{}
+	for _, c := range cases {
+		names[c.Name] = true
+		reason, known := knownDivergences[c.Name]
+		output, ok := generatedOutputs[c.Name]
+		switch {
+		case !ok && !known:
+			t.Errorf("%s: %s", c.Name, failures[c.Name])
+		case !ok:
+			t.Logf("%s: %s (%s)", c.Name, failures[c.Name], reason)
+		case ok && known && output == c.Output:
+			t.Errorf("%s: generated code no longer diverges (%s), so it should be removed from knownDivergences", c.Name, reason)
+		case ok && !known && output != c.Output:
+			t.Errorf("%s: generated and evaluated output do not match:\n\tEvaluated: %q\n\tGenerated: %q", c.Name, c.Output, output)
+		}
+	}
+	// Cases are only missing if tests were selected with -run
+	if flag.Lookup("test.run").Value.String() == "" {
+		for name := range knownDivergences {
+			if !names[name] {
+				t.Errorf("%s: no such case, so it should be removed from knownDivergences", name)
+			}
+		}
+	}
+	t.Logf("checked %d of %d cases", len(generated), len(cases))
+}
+
+// A generateJob is a case for the generator program to generate code for
+type generateJob struct {
+	File, Func, Type string
+	Input            string // The template, which is parsed as testFrag parses it
+	StructTags       bool
+}
+
+// generateMain is the generator program, which reads a JSON array of generateJobs from stdin,
+// and writes a JSON array of the errors generating each, or empty strings if there were none.
+const generateMain = `package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vktec/htmpl/gen"
+	"golang.org/x/net/html"
+)
+
+type job struct {
+	File, Func, Type string
+	Input            string
+	StructTags       bool
+}
+
+func main() {
+	var jobs []job
+	if err := json.NewDecoder(os.Stdin).Decode(&jobs); err != nil {
+		panic(err)
+	}
+	errs := make([]string, len(jobs))
+	for i, j := range jobs {
+		if err := generate(j); err != nil {
+			errs[i] = err.Error()
+			os.Remove(j.File)
+		}
+	}
+	json.NewEncoder(os.Stdout).Encode(errs)
+}
+
+// generate parses the template of a job as testFrag does and generates its code, reporting a panic as an error
+func generate(j job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	root := &html.Node{Type: html.ElementNode}
+	nodes, err := html.ParseFragment(strings.NewReader(j.Input), root)
+	if err != nil {
+		return err
+	}
+	root.Type = html.DocumentNode
+	for _, child := range nodes {
+		root.AppendChild(child)
+	}
+	return (&gen.Config{StructTags: j.StructTags}).Generate(j.File, j.Func, j.Type, root)
+}
+`
+
+// goCommand returns a command running the go tool in dir, without network access
+func goCommand(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOWORK=off")
+	return cmd
+}
+
+// runJSON runs a command and decodes its output as JSON into v
+func runJSON(t *testing.T, cmd *exec.Cmd, v interface{}) {
+	t.Helper()
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			t.Fatalf("%s: %v\n%s", strings.Join(cmd.Args, " "), err, exitErr.Stderr)
+		}
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testMethods returns the declarations of the types with methods in a test file, and of their methods, by the names of the types
+func testMethods(file string) (map[string]string, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	text := func(n ast.Node) string {
+		return string(src[fset.Position(n.Pos()).Offset:fset.Position(n.End()).Offset])
+	}
+
+	methods := map[string][]string{}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv != nil {
+			recv := fn.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			if ident, ok := recv.(*ast.Ident); ok {
+				methods[ident.Name] = append(methods[ident.Name], text(fn))
+			}
+		}
+	}
+	decls := map[string]string{}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.TypeSpec)
+			if m := methods[spec.Name.Name]; len(m) > 0 {
+				decls[spec.Name.Name] = "type " + text(spec) + "\n\n" + strings.Join(m, "\n\n") + "\n\n"
+			}
+		}
+	}
+	return decls, nil
+}
+
+// writeModule creates a module in dir that requires the same modules as the one in root, and replaces this module with root
+func writeModule(root, dir string) error {
+	mod, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return err
+	}
+	sum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(mod), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "module ") {
+			lines[i] = "module parity\n"
+		}
+	}
+	mod = []byte(strings.Join(lines, "") + fmt.Sprintf("\nrequire github.com/vktec/htmpl v0.0.0\n\nreplace github.com/vktec/htmpl => %s\n", root))
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), mod, 0666); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "go.sum"), sum, 0666)
+}
+
+// goWriter writes Go code for values created by tests
+type goWriter struct {
+	imports map[string]bool         // The paths of the packages used by the code
+	named   map[reflect.Type]string // The names of the types declared in the code
+	names   map[string]bool         // The names used by declarations in the code
+	methods map[string]string       // The declarations of the test types with methods, and of their methods, by the names of the types
+	tags    bool                    // Whether fields of structs in the code are named by their struct tags
+	decls   strings.Builder
+}
+
+// concrete returns Go code for v and its type.
+// Interface values are replaced by their dynamic values, and where possible, maps and slices of interface values are replaced by
+// maps and slices of the type of their elements, or by structs with a field for each key, as generated code cannot substitute interface values.
+// If any structs are used, w.tags is set, and the code must be generated with StructTags set.
+func (w *goWriter) concrete(v reflect.Value) (code, typ string, err error) {
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", "", errors.New("nil interface value")
+		}
+		v = v.Elem()
+	}
+	t := v.Type()
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if t.Name() == "" && v.Len() > 0 && t.Elem().Kind() == reflect.Interface {
+			return w.concreteElems(v)
+		}
+	}
+	typ, err = w.typeExpr(t)
+	if err != nil {
+		return "", "", err
+	}
+	code, err = w.value(v, typ)
+	return code, typ, err
+}
+
+// concreteElems returns Go code for a map or slice of interface values, and its type
+func (w *goWriter) concreteElems(v reflect.Value) (code, typ string, err error) {
+	t := v.Type()
+	if t.Kind() != reflect.Map {
+		elems := make([]string, v.Len())
+		var elemTyp string
+		for i := range elems {
+			code, typ, err := w.concrete(v.Index(i))
+			if err != nil {
+				return "", "", err
+			}
+			if i > 0 && typ != elemTyp {
+				return "", "", fmt.Errorf("elements of %s have different types", t)
+			}
+			elems[i], elemTyp = code, typ
+		}
+		return fmt.Sprintf("[]%s{%s}", elemTyp, strings.Join(elems, ", ")), "[]" + elemTyp, nil
+	}
+
+	// Nil values are omitted, as they cannot be given a type
+	var keys []reflect.Value
+	for _, key := range sortedValues(v.MapKeys()) {
+		if !v.MapIndex(key).IsNil() {
+			keys = append(keys, key)
+		}
+	}
+	keyTyp, err := w.typeExpr(t.Key())
+	if err != nil || len(keys) == 0 {
+		return "", "", fmt.Errorf("map of %s has no values with types", t.Elem())
+	}
+	elems := make([]string, len(keys))
+	fields := make([]string, len(keys))
+	var elemTyp string
+	uniform := true
+	for i, key := range keys {
+		code, typ, err := w.concrete(v.MapIndex(key))
+		if err != nil {
+			return "", "", err
+		}
+		keyCode, err := w.value(key, keyTyp)
+		if err != nil {
+			return "", "", err
+		}
+		uniform = uniform && (i == 0 || typ == elemTyp)
+		elemTyp = typ
+		elems[i] = keyCode + ": " + code
+		if key.Kind() == reflect.String && key.String() != "-" && !strings.Contains(key.String(), ",") {
+			fields[i] = fmt.Sprintf("F%d %s %s", i, typ, strconv.Quote(fmt.Sprintf("htmpl:%q", key.String())))
+		}
+	}
+	if uniform {
+		typ := fmt.Sprintf("map[%s]%s", keyTyp, elemTyp)
+		return fmt.Sprintf("%s{%s}", typ, strings.Join(elems, ", ")), typ, nil
+	}
+
+	// Values of different types are stored in the fields of a struct instead, which are named by the keys in their struct tags,
+	// as the keys may not be exported identifiers
+	for i, key := range keys {
+		if fields[i] == "" {
+			return "", "", fmt.Errorf("map key %q cannot be a struct tag", key)
+		}
+		elems[i] = fmt.Sprintf("F%d%s", i, elems[i][strings.IndexByte(elems[i], ':'):])
+	}
+	w.tags = true
+	typ = "struct{" + strings.Join(fields, "; ") + "}"
+	return fmt.Sprintf("%s{%s}", typ, strings.Join(elems, ", ")), typ, nil
+}
+
+// value returns Go code for v, which is converted to the type typ
+func (w *goWriter) value(v reflect.Value, typ string) (string, error) {
+	t := v.Type()
+	switch v.Kind() {
+	case reflect.Bool:
+		return fmt.Sprintf("%s(%t)", typ, v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprintf("%s(%d)", typ, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return fmt.Sprintf("%s(%d)", typ, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return fmt.Sprintf("%s(%s)", typ, strconv.FormatFloat(v.Float(), 'g', -1, 64)), nil
+	case reflect.String:
+		return fmt.Sprintf("%s(%q)", typ, v.String()), nil
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return fmt.Sprintf("%s(nil)", typ), nil
+		}
+		elems := make([]string, v.Len())
+		for i := range elems {
+			code, err := w.elem(v.Index(i), t.Elem())
+			if err != nil {
+				return "", err
+			}
+			elems[i] = code
+		}
+		return fmt.Sprintf("%s{%s}", typ, strings.Join(elems, ", ")), nil
+
+	case reflect.Map:
+		if v.IsNil() {
+			return fmt.Sprintf("%s(nil)", typ), nil
+		}
+		var elems []string
+		for _, key := range sortedValues(v.MapKeys()) {
+			keyCode, err := w.elem(key, t.Key())
+			if err != nil {
+				return "", err
+			}
+			code, err := w.elem(v.MapIndex(key), t.Elem())
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, keyCode+": "+code)
+		}
+		return fmt.Sprintf("%s{%s}", typ, strings.Join(elems, ", ")), nil
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return fmt.Sprintf("(%s)(nil)", typ), nil
+		}
+		code, err := w.elem(v.Elem(), t.Elem())
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("ptr(%s)", code), nil
+
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if v.Field(i).IsZero() {
+				continue
+			}
+			if !f.IsExported() && !w.declared(t) {
+				return "", fmt.Errorf("unexported field %s of %s", f.Name, t)
+			}
+			code, err := w.elem(v.Field(i), f.Type)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, f.Name+": "+code)
+		}
+		return fmt.Sprintf("%s{%s}", typ, strings.Join(fields, ", ")), nil
+	}
+	return "", fmt.Errorf("unsupported value of type %s", t)
+}
+
+// elem returns Go code for v, which is stored in a variable of type t
+func (w *goWriter) elem(v reflect.Value, t reflect.Type) (string, error) {
+	if t.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "nil", nil
+		}
+		code, _, err := w.concrete(v.Elem())
+		return code, err
+	}
+	typ, err := w.typeExpr(t)
+	if err != nil {
+		return "", err
+	}
+	return w.value(v, typ)
+}
+
+// declared returns true if t is declared in the code, rather than imported
+func (w *goWriter) declared(t reflect.Type) bool {
+	_, ok := w.named[t]
+	return ok
+}
+
+// typeExpr returns a Go expression for t.
+// Unexported types declared by tests are declared in the code, and named types from other packages are imported.
+func (w *goWriter) typeExpr(t reflect.Type) (string, error) {
+	if t.Name() != "" {
+		switch {
+		case strings.ContainsRune(t.Name(), '['):
+			return "", fmt.Errorf("unsupported generic type %s", t)
+		case t.PkgPath() == "":
+			return t.Name(), nil
+		case t.PkgPath() != "github.com/vktec/htmpl" || token.IsExported(t.Name()):
+			w.imports[t.PkgPath()] = true
+			return path.Base(t.PkgPath()) + "." + t.Name(), nil
+		}
+		return w.declare(t)
+	}
+	return w.underlying(t)
+}
+
+// underlying returns a Go expression for the underlying type of t
+func (w *goWriter) underlying(t reflect.Type) (string, error) {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.String:
+		return t.Kind().String(), nil
+	case reflect.Slice, reflect.Ptr:
+		elem, err := w.typeExpr(t.Elem())
+		if t.Kind() == reflect.Slice {
+			return "[]" + elem, err
+		}
+		return "*" + elem, err
+	case reflect.Array:
+		elem, err := w.typeExpr(t.Elem())
+		return fmt.Sprintf("[%d]%s", t.Len(), elem), err
+	case reflect.Map:
+		key, err := w.typeExpr(t.Key())
+		if err != nil {
+			return "", err
+		}
+		elem, err := w.typeExpr(t.Elem())
+		return fmt.Sprintf("map[%s]%s", key, elem), err
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return "interface{}", nil
+		}
+	case reflect.Struct:
+		fields := make([]string, t.NumField())
+		for i := range fields {
+			f := t.Field(i)
+			typ, err := w.typeExpr(f.Type)
+			if err != nil {
+				return "", err
+			}
+			if f.Anonymous {
+				if typ[strings.LastIndexAny(typ, "*.")+1:] != f.Name {
+					return "", fmt.Errorf("embedded field %s of %s is declared as %s", f.Name, t, typ)
+				}
+				fields[i] = typ
+			} else {
+				fields[i] = f.Name + " " + typ
+			}
+			if f.Tag != "" {
+				fields[i] += " " + strconv.Quote(string(f.Tag))
+			}
+		}
+		return "struct{" + strings.Join(fields, "; ") + "}", nil
+	}
+	return "", fmt.Errorf("unsupported type %s", t)
+}
+
+// declare declares a type with the same name and underlying type as t.
+// Types with methods are copied from the declarations in the test file, with their methods.
+func (w *goWriter) declare(t reflect.Type) (string, error) {
+	if name, ok := w.named[t]; ok {
+		return name, nil
+	}
+	if t.NumMethod() > 0 || reflect.PointerTo(t).NumMethod() > 0 {
+		decl, ok := w.methods[t.Name()]
+		if !ok || w.names[t.Name()] {
+			return "", fmt.Errorf("type %s has methods, but is not declared in the test file", t)
+		}
+		w.named[t], w.names[t.Name()] = t.Name(), true
+		w.decls.WriteString(decl)
+		return t.Name(), nil
+	}
+	name := t.Name()
+	for i := 2; w.names[name]; i++ {
+		name = fmt.Sprintf("%s%d", t.Name(), i)
+	}
+	// The name is reserved first, as the underlying type may refer to t
+	w.named[t], w.names[name] = name, true
+	underlying, err := w.underlying(t)
+	if err != nil {
+		delete(w.named, t)
+		delete(w.names, name)
+		return "", err
+	}
+	fmt.Fprintf(&w.decls, "type %s %s\n\n", name, underlying)
+	return name, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedValues sorts map keys by their formatted values, so the generated code is deterministic
+func sortedValues(keys []reflect.Value) []reflect.Value {
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
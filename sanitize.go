@@ -0,0 +1,170 @@
+package htmpl
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// A Policy is an allowlist of the HTML permitted in the output of <v noescape> elements.
+// Elements that are not permitted are replaced by their content, except for those such as <script> whose content is not text,
+// which are removed entirely. Attributes that are not permitted, and URLs with schemes that are not permitted, are removed.
+// Comments and doctypes are always removed.
+//
+// Templates have no policy unless Config.Policy is set, so <v noescape> output is not sanitized by default.
+type Policy struct {
+	// Elements maps the names of the permitted elements to the attributes permitted on them
+	Elements map[string][]string
+	// Attrs contains the attributes permitted on all permitted elements
+	Attrs []string
+	// URLSchemes contains the schemes permitted in attributes containing URLs, such as href.
+	// Relative URLs are always permitted.
+	URLSchemes []string
+}
+
+// DefaultPolicy returns a policy permitting the formatting elements commonly allowed in user-generated content,
+// with links and images restricted to http, https and mailto URLs.
+// The returned policy may be modified, such as to permit more elements.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Elements: map[string][]string{
+			"a":          {"href"},
+			"abbr":       nil,
+			"b":          nil,
+			"blockquote": {"cite"},
+			"br":         nil,
+			"caption":    nil,
+			"cite":       nil,
+			"code":       nil,
+			"dd":         nil,
+			"del":        nil,
+			"dl":         nil,
+			"dt":         nil,
+			"em":         nil,
+			"figcaption": nil,
+			"figure":     nil,
+			"h1":         nil,
+			"h2":         nil,
+			"h3":         nil,
+			"h4":         nil,
+			"h5":         nil,
+			"h6":         nil,
+			"hr":         nil,
+			"i":          nil,
+			"img":        {"src", "alt", "width", "height"},
+			"ins":        nil,
+			"kbd":        nil,
+			"li":         nil,
+			"mark":       nil,
+			"ol":         {"start"},
+			"p":          nil,
+			"pre":        nil,
+			"q":          {"cite"},
+			"s":          nil,
+			"small":      nil,
+			"span":       nil,
+			"strong":     nil,
+			"sub":        nil,
+			"sup":        nil,
+			"table":      nil,
+			"tbody":      nil,
+			"td":         {"colspan", "rowspan"},
+			"tfoot":      nil,
+			"th":         {"colspan", "rowspan"},
+			"thead":      nil,
+			"tr":         nil,
+			"u":          nil,
+			"ul":         nil,
+		},
+		Attrs:      []string{"title", "lang", "dir"},
+		URLSchemes: []string{"http", "https", "mailto"},
+	}
+}
+
+// opaqueElements contains the elements whose content is removed along with them, as it is not text that can be kept
+var opaqueElements = map[string]bool{
+	"iframe":    true,
+	"math":      true,
+	"noembed":   true,
+	"noframes":  true,
+	"noscript":  true,
+	"object":    true,
+	"plaintext": true,
+	"script":    true,
+	"style":     true,
+	"svg":       true,
+	"template":  true,
+	"textarea":  true,
+	"title":     true,
+	"xmp":       true,
+}
+
+// Sanitize removes the descendants of node that are not permitted by the policy, modifying the tree in place
+func (p *Policy) Sanitize(node *html.Node) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		switch child.Type {
+		case html.TextNode:
+		case html.ElementNode:
+			name := strings.ToLower(child.Data)
+			attrs, ok := p.Elements[name]
+			switch {
+			case ok && child.Namespace == "":
+				child.Attr = p.attrs(child.Attr, attrs)
+				p.Sanitize(child)
+			case opaqueElements[name] || child.Namespace != "":
+				node.RemoveChild(child)
+			default:
+				// Replace the element with its sanitized content
+				p.Sanitize(child)
+				for grandchild := child.FirstChild; grandchild != nil; grandchild = child.FirstChild {
+					child.RemoveChild(grandchild)
+					node.InsertBefore(grandchild, child)
+				}
+				node.RemoveChild(child)
+			}
+		default:
+			node.RemoveChild(child)
+		}
+		child = next
+	}
+}
+
+// attrs filters a list of attributes, keeping those permitted on all elements or in the given list
+func (p *Policy) attrs(attrs []html.Attribute, permitted []string) []html.Attribute {
+	ret := attrs[:0]
+	for _, attr := range attrs {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" || !contains(p.Attrs, key) && !contains(permitted, key) {
+			continue
+		}
+		if AttrContext(key) == ContextURL && !p.allowURL(attr.Val) {
+			continue
+		}
+		ret = append(ret, attr)
+	}
+	return ret
+}
+
+// allowURL returns true if a URL is relative or has a permitted scheme
+func (p *Policy) allowURL(url string) bool {
+	i := strings.IndexAny(url, ":/?#")
+	if i < 0 || url[i] != ':' {
+		return true
+	}
+	for _, scheme := range p.URLSchemes {
+		if strings.EqualFold(url[:i], scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package htmpl
+
+import (
+	htmltemplate "html/template"
+	"reflect"
+
+	"github.com/vktec/htmlparse"
+	"golang.org/x/net/html"
+)
+
+// HTML is a string of trusted HTML.
+// It is substituted as HTML by <v> elements, without the noescape attribute, and is not sanitized even if the template has a Policy.
+// In other contexts, it is escaped like any other string.
+type HTML string
+
+// URL is a trusted URL.
+// In attributes containing URLs, its scheme is not checked, so it may be a javascript: URL, but characters not permitted in URLs are still percent-encoded.
+type URL string
+
+// JS is a trusted JavaScript expression.
+// It is substituted unchanged in <script v> elements and event handler attributes, rather than being encoded as a string.
+type JS string
+
+// CSS is a trusted CSS value.
+// It is substituted unchanged in <style v> elements and style attributes, rather than being filtered.
+type CSS string
+
+// trusted returns the context in which a value of a trusted type may be substituted without the usual escaping, and its content.
+// The types from html/template are trusted in the same way as their equivalents in this package.
+func trusted(v reflect.Value) (ctx Context, s string, ok bool) {
+	if !v.IsValid() || !v.CanInterface() || v.Kind() != reflect.String {
+		return
+	}
+	switch v.Interface().(type) {
+	case HTML, htmltemplate.HTML:
+		return ContextText, v.String(), true
+	case URL, htmltemplate.URL:
+		return ContextURL, v.String(), true
+	case JS, htmltemplate.JS:
+		return ContextJS, v.String(), true
+	case CSS, htmltemplate.CSS:
+		return ContextCSS, v.String(), true
+	}
+	return
+}
+
+// parseHTML parses a string of HTML, sanitizing it if policy is not nil
+func parseHTML(s string, policy *Policy) []*html.Node {
+	p := html.Node{}
+	htmlparse.Parse(&p, []byte(s))
+	if policy != nil {
+		policy.Sanitize(&p)
+	}
+	var nodes []*html.Node
+	for child := p.FirstChild; child != nil; child = child.NextSibling {
+		nodes = append(nodes, child)
+	}
+	return nodes
+}